@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// 金额统一用int64表示，单位是聪(satoshi)，1 BTC = 100000000聪
+//  用float64表示金额会有精度问题，多次转账之后余额就对不上了
+//  只有在命令行输入输出的时候才和十进制的BTC字符串互相转换
+
+const (
+	SatoshiPerBitcoin = 100000000
+	// BTC的小数位数，也就是1聪对应的位数
+	amountDecimals = 8
+)
+
+// 把十进制的BTC字符串解析成聪，例如"12.5" -> 1250000000
+//  不经过float64，避免精度问题，最多允许8位小数，不允许负数
+func ParseAmount(s string) (int64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("amount is empty")
+	}
+
+	intPart, fracPart := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	if intPart == "" && fracPart == "" {
+		return 0, fmt.Errorf("amount %s is invalid", s)
+	}
+	if len(fracPart) > amountDecimals {
+		return 0, fmt.Errorf("amount %s has more than %d decimals", s, amountDecimals)
+	}
+	// 小数部分补齐到8位，整个字符串就是以聪为单位的整数
+	digits := intPart + fracPart + strings.Repeat("0", amountDecimals-len(fracPart))
+
+	var amount int64
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("amount %s is invalid", s)
+		}
+		if amount > (math.MaxInt64-int64(c-'0'))/10 {
+			return 0, fmt.Errorf("amount %s is too large", s)
+		}
+		amount = amount*10 + int64(c-'0')
+	}
+	return amount, nil
+}
+
+// 把聪格式化成十进制的BTC字符串，固定8位小数，例如1250000000 -> "12.50000000"
+func FormatAmount(amount int64) string {
+	sign := ""
+	// 取绝对值时用uint64，避免math.MinInt64溢出
+	abs := uint64(amount)
+	if amount < 0 {
+		sign = "-"
+		abs = uint64(-amount)
+	}
+	return fmt.Sprintf("%s%d.%08d", sign, abs/SatoshiPerBitcoin, abs%SatoshiPerBitcoin)
+}
+
+// 检查单个金额，必须在[0, MaxSupply()]之间
+//  超出范围的金额求和时可能溢出，溢出之后就能凭空造出币来
+func CheckAmount(amount int64) error {
+	if amount < 0 {
+		return fmt.Errorf("amount %s is negative", FormatAmount(amount))
+	}
+	if amount > MaxSupply() {
+		return fmt.Errorf("amount %s exceeds max supply", FormatAmount(amount))
+	}
+	return nil
+}
+
+// 把amount加到total上，每加一次都检查，总额超过MaxSupply()时返回错误而不是溢出
+func AddAmount(total, amount int64) (int64, error) {
+	if err := CheckAmount(amount); err != nil {
+		return 0, err
+	}
+	if amount > MaxSupply()-total {
+		return 0, fmt.Errorf("total amount exceeds max supply")
+	}
+	return total + amount, nil
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"log"
 	"time"
 )
@@ -23,6 +23,8 @@ type Block struct {
 	Difficulty uint64
 	// 随机数，也就是挖矿要找的数据
 	Nonce uint64
+	// 区块高度，创世块为0
+	Height uint64
 	// 2. 当前区块hash，正常BTC区块中没有当前区块的hash，我们是为了方便做了简化
 	Hash []byte
 	// 3. 数据
@@ -45,14 +47,20 @@ func Uint64ToByte(num uint64) []byte {
 }
 
 // 2. 创建区块
-func NewBlock(txs []*Transaction, prevBlockHash []byte) *Block {
+func NewBlock(txs []*Transaction, prevBlockHash []byte, height, bits uint64) *Block {
+	return newBlockAt(txs, prevBlockHash, height, bits, uint64(time.Now().Unix()))
+}
+
+// 指定时间戳创建区块，创世块需要固定的时间戳
+func newBlockAt(txs []*Transaction, prevBlockHash []byte, height, bits, timestamp uint64) *Block {
 	block := &Block{
 		Version:    00,
 		PrevHash:   prevBlockHash,
 		MerkelRoot: []byte{},
-		TimeStamp:  uint64(time.Now().Unix()),
-		Difficulty: 0,
+		TimeStamp:  timestamp,
+		Difficulty: bits,
 		Nonce:      0,
+		Height:     height,
 		Hash:       []byte{},
 		//Data:       []byte(data),
 		Transactions: txs,
@@ -85,13 +93,25 @@ func (b *Block) Serialize() []byte {
 
 // 反序列化
 func Deserialize(data []byte) *Block {
+	block, err := DeserializeBlock(data)
+	if err != nil {
+		log.Panic("decode failed")
+	}
+	return block
+}
+
+// 反序列化其他节点发来的区块，数据不可信，出错时返回错误而不是panic
+func DeserializeBlock(data []byte) (*Block, error) {
 	decoder := gob.NewDecoder(bytes.NewReader(data))
 	var block *Block
 	err := decoder.Decode(&block)
 	if err != nil {
-		log.Panic("decode failed")
+		return nil, err
 	}
-	return block
+	if block == nil {
+		return nil, errors.New("empty block")
+	}
+	return block, nil
 }
 
 /*
@@ -124,15 +144,20 @@ func (b *Block) SetHash() {
 }
 */
 
-// 模拟梅克尔根，只是对交易的数据做简单的拼接，而不做二叉树处理
+// 生成梅克尔根，用所有交易的TxID构建一颗二叉梅克尔树
 func (b *Block) MakeMerkelRoot() []byte {
-	//var info []byte
-	var finalInfo [][]byte
-	// 将交易的hash值拼接起来，再整体做hash处理
+	return b.merkleTree().Root()
+}
+
+func (b *Block) merkleTree() *MerkleTree {
+	var txIDs [][]byte
 	for _, tx := range b.Transactions {
-		//info = append(info, tx.TxID...)
-		finalInfo = append(finalInfo, tx.TxID)
+		txIDs = append(txIDs, tx.TxID)
 	}
-	hash := sha256.Sum256(bytes.Join(finalInfo, []byte{}))
-	return hash[:]
+	return NewMerkleTree(txIDs)
+}
+
+// 生成交易在当前区块中的梅克尔证明，校验时只需要证明路径和区块头中的MerkelRoot，不需要整个区块
+func (b *Block) MerkleProof(txID []byte) ([]*MerkleProofNode, error) {
+	return b.merkleTree().Proof(txID)
 }
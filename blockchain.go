@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/boltdb/bolt"
@@ -12,7 +14,16 @@ import (
 const (
 	blockChainDB     = "blockChain.db"
 	blockChainBucket = "blockBucket"
+	utxoBucket       = "utxoBucket"
+	heightBucket     = "heightBucket"   // 主链的高度索引，map[高度]区块hash
+	workBucket       = "workBucket"     // 累计工作量，map[区块hash]从创世块到这个区块的总工作量
+	undoBucket       = "undoBucket"     // 回滚数据，map[区块hash]区块花费掉的output
+	metaBucket       = "metaBucket"     // 数据库的元数据，目前只有格式版本
+	migratedBucket   = "migratedBucket" // 从旧版本迁移过来的区块，map[区块hash]迁移前的版本
+	dbVersionKey     = "DBVersion"
 	lastHashKey      = "LastHashKey"
+	// 创世块的时间戳 2021-11-18 00:00:00 UTC
+	genesisTimestamp = 1637193600
 )
 
 // 4. 引入区块链
@@ -44,160 +55,297 @@ func NewBlockChain(addr string) *BlockChain {
 				log.Panic("create bucket failed")
 			}
 
+			for _, name := range []string{utxoBucket, heightBucket, workBucket, undoBucket, migratedBucket} {
+				_, err = tx.CreateBucket([]byte(name))
+				if err != nil {
+					log.Panic("create bucket failed")
+				}
+			}
+
 			// 创建一个创世块，并作为第一个区块添加到区块链中
 			genesisBlock := GenesisBlock(addr)
 			bucket.Put(genesisBlock.Hash, genesisBlock.Serialize())
 			bucket.Put([]byte(lastHashKey), genesisBlock.Hash)
+			tx.Bucket([]byte(heightBucket)).Put(Uint64ToByte(genesisBlock.Height), genesisBlock.Hash)
+			tx.Bucket([]byte(workBucket)).Put(genesisBlock.Hash, BlockWork(genesisBlock.Difficulty).Bytes())
+			err = UTXOSet{}.Update(tx, genesisBlock)
+			if err != nil {
+				log.Panic(err)
+			}
+			err = putDBVersion(tx, dbVersion)
+			if err != nil {
+				log.Panic(err)
+			}
 		}
 
-		lastHash = bucket.Get([]byte(lastHashKey))
+		// Get返回的数据只在事务内有效，之后迁移数据库时可能被重新映射，需要复制一份
+		lastHash = append([]byte{}, bucket.Get([]byte(lastHashKey))...)
 
 		return nil
 	})
 
-	return &BlockChain{
+	bc := &BlockChain{
 		db:   db,
 		tail: lastHash,
 	}
+
+	// 旧版本数据库的数据格式不兼容，先迁移成当前的格式
+	bc.migrate()
+
+	// 旧版本的数据库没有高度索引、累计工作量、UTXO集合和回滚数据，需要遍历一次区块链重建
+	var hasHeightBucket, hasWorkBucket, hasUTXOBucket, hasUndoBucket bool
+	db.View(func(tx *bolt.Tx) error {
+		hasHeightBucket = tx.Bucket([]byte(heightBucket)) != nil
+		hasWorkBucket = tx.Bucket([]byte(workBucket)) != nil
+		hasUTXOBucket = tx.Bucket([]byte(utxoBucket)) != nil
+		hasUndoBucket = tx.Bucket([]byte(undoBucket)) != nil
+		return nil
+	})
+	if !hasHeightBucket {
+		bc.reindexHeight()
+	}
+	if !hasWorkBucket {
+		bc.reindexWork()
+	}
+	if !hasUTXOBucket || !hasUndoBucket {
+		UTXOSet{bc}.Reindex()
+	}
+
+	return bc
 }
 
 // 定义一个创世块
+//  创世块的时间戳是固定的，不同节点用同一个地址创建的创世块完全相同，才能互相同步区块
+//  所以创世块的挖矿交易保持旧的格式，ScriptSig中直接是数据，没有随机的ExtraNonce
 func GenesisBlock(addr string) *Block {
-	coinbase := NewCoinBaseTx(addr, "BTC创世块，老牛逼了")
-	return NewBlock([]*Transaction{coinbase}, []byte{})
+	coinbase := NewCoinBaseTx(addr, "", 0, 0)
+	coinbase.TxInputs[0].ScriptSig = []byte("BTC创世块，老牛逼了")
+	coinbase.Timestamp = genesisTimestamp
+	coinbase.TxID = nil
+	coinbase.SetHash()
+	return newBlockAt([]*Transaction{coinbase}, []byte{}, 0, InitialBits, genesisTimestamp)
+}
+
+// 重建高度索引，旧版本的区块中没有高度，按照在链上的位置计算
+func (bc *BlockChain) reindexHeight() {
+	var hashes [][]byte
+	it := bc.NewIterator()
+	for {
+		block := it.Next()
+		hashes = append(hashes, block.Hash)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	bc.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(heightBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		// hashes是从后往前存的，最后一个是创世块
+		for i, hash := range hashes {
+			height := uint64(len(hashes) - 1 - i)
+			err = bucket.Put(Uint64ToByte(height), hash)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		return nil
+	})
 }
 
-// 6. 添加区块
-func (bc *BlockChain) AddBlock(txs []*Transaction) {
+// 6. 添加区块，挖矿成功返回新的区块，失败返回nil
+func (bc *BlockChain) AddBlock(txs []*Transaction) *Block {
 
 	for _, tx := range txs {
 		if !bc.VerifyTransaction(tx) {
 			log.Println("miner verify tx failed")
-			return
+			return nil
 		}
 	}
+	return bc.appendBlock(txs)
+}
 
-	// 获取最后一个区块的hash
-	db := bc.db
-	lastHash := bc.tail
+// 把交易打包成区块，挖矿之后接在最后一个区块后面
+//  交易在连接区块时才校验，可以花费同一个区块中前面交易的output
+func (bc *BlockChain) appendBlock(txs []*Transaction) *Block {
+	// 获取最后一个区块
+	lastBlock, err := bc.GetBlockByHash(bc.tail)
+	if err != nil {
+		log.Panic(err)
+	}
 
-	db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte(blockChainBucket))
-		if bucket == nil {
-			log.Panic("bucket must be not nil")
+	// 创建新的区块，接在最后一个区块后面
+	block := NewBlock(txs, lastBlock.Hash, lastBlock.Height+1, bc.nextDifficulty(lastBlock))
+
+	// 接在主链最后一个区块后面，不会发生重组
+	_, err = bc.ProcessBlock(block)
+	if err != nil {
+		log.Println("add block failed:", err)
+		return nil
+	}
+	return block
+}
+
+// 计算下一个区块的难度值
+func (bc *BlockChain) NextDifficulty() uint64 {
+	tail, err := bc.GetBlockByHash(bc.tail)
+	if err != nil {
+		log.Panic(err)
+	}
+	return bc.nextDifficulty(tail)
+}
+
+// 计算接在prev后面的区块的难度值，prev不一定在主链上
+//  每RetargetInterval个区块调整一次，根据这个周期内实际的出块时间和TargetBlockSpacing比较
+//  没到调整的高度就沿用prev的难度
+func (bc *BlockChain) nextDifficulty(prev *Block) uint64 {
+	bits := prev.Difficulty
+	// 旧版本的区块没有难度值
+	if bits == 0 {
+		bits = InitialBits
+	}
+
+	if (prev.Height+1)%RetargetInterval != 0 {
+		return bits
+	}
+
+	// 这个周期的第一个区块，第一个周期从创世块开始
+	//  prev可能在分叉上，不能用高度索引，沿着PrevHash往前找
+	first := prev
+	for i := 0; i < RetargetInterval && len(first.PrevHash) != 0; i++ {
+		var err error
+		first, err = bc.GetBlockByHash(first.PrevHash)
+		if err != nil {
+			log.Panic(err)
 		}
+	}
 
-		// a. 创建新的区块
-		block := NewBlock(txs, lastHash)
-		// b. 添加到区块链到DB中
-		bucket.Put(block.Hash, block.Serialize())
-		bucket.Put([]byte(lastHashKey), block.Hash)
-		bc.tail = block.Hash
+	actualTimespan := int64(prev.TimeStamp) - int64(first.TimeStamp)
+	targetTimespan := int64(prev.Height-first.Height) * TargetBlockSpacing
 
+	newBits := RetargetDifficulty(bits, actualTimespan, targetTimespan)
+	log.Printf("retarget difficulty at height %d: %08x -> %08x (actual %ds, target %ds)\n",
+		prev.Height+1, bits, newBits, actualTimespan, targetTimespan)
+	return newBits
+}
+
+// 返回最后一个区块的高度
+func (bc *BlockChain) GetBestHeight() uint64 {
+	var height uint64
+
+	bc.db.View(func(tx *bolt.Tx) error {
+		// 高度索引的key是大端序的高度，最后一个key就是最大的高度
+		cursor := tx.Bucket([]byte(heightBucket)).Cursor()
+		k, _ := cursor.Last()
+		if k != nil {
+			height = binary.BigEndian.Uint64(k)
+		}
 		return nil
 	})
+
+	return height
 }
 
-// 找到指定地址的所有的UTXO
-func (bc *BlockChain) FindUTXOs(pubKeyHash []byte) []*TxOutput {
-	var utxos = make([]*TxOutput, 0, 4)
-	transactions, spentOutputs := bc.FindUTXOTransactions(pubKeyHash)
-	// 1. 遍历区块
-	// 2. 遍历交易
-	// 3. 遍历output，找到和自己相关的UTXO(在添加output之前，检查是否已经消耗过)
-	// 4. 遍历input，找到自己花费过的UTXO(把自己消耗过的给标识出来)
-
-	for _, tx := range transactions {
-		for i, output := range tx.TxOutputs {
-			// 在这里做一个过滤，将所有消耗过的output和当前即将要添加的output对比一下
-			// 如果相同则跳过
-			key := fmt.Sprintf("%x:%d", tx.TxID, i)
-			if _, ok := spentOutputs[key]; ok { // 当前准备添加的output已经消耗了，不要加了
-				continue
-			}
+// 根据hash直接从数据库读取区块，不需要遍历区块链
+func (bc *BlockChain) GetBlockByHash(hash []byte) (*Block, error) {
+	var block *Block
 
-			// 这个output和我们的目标地址相同，加到返回的UTXOs切片中
-			if bytes.Equal(pubKeyHash, output.PubKeyHash) {
-				utxos = append(utxos, output)
-			}
+	bc.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(blockChainBucket)).Get(hash)
+		if data != nil {
+			block = Deserialize(data)
 		}
-	}
+		return nil
+	})
 
-	return utxos
+	if block == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	return block, nil
 }
 
-// 找到足够转账额的UTXO
-//  @return map[string][]int 以map[TxID][]int{outputIndex1, outputIndex2 ...}形式返回
-//  @return float64 返回需要的余额或者总余额
-func (bc *BlockChain) FindNeedUTXOs(senderPubKeyHash []byte, amount float64) (map[string][]int, float64) {
-	var utxos = make(map[string][]int)
-	var totalAmount float64
-	transactions, spentOutputs := bc.FindUTXOTransactions(senderPubKeyHash)
-
-	for _, tx := range transactions {
-		for i, output := range tx.TxOutputs {
-			// 在这里做一个过滤，将所有消耗过的output和当前即将要添加的output对比一下
-			key := fmt.Sprintf("%x:%d", tx.TxID, i)
-			if _, ok := spentOutputs[key]; ok { // 当前准备添加的output已经消耗了，不要加了
-				continue
-			}
+// 根据高度查找区块，先通过高度索引找到hash，再读取区块
+func (bc *BlockChain) GetBlockByHeight(height uint64) (*Block, error) {
+	var hash []byte
 
-			// 这个output和我们的目标地址相同，加到返回的utxos map中
-			if bytes.Equal(senderPubKeyHash, output.PubKeyHash) {
-				utxos[string(tx.TxID)] = append(utxos[string(tx.TxID)], i)
-				totalAmount += output.Amount
-				if totalAmount >= amount { // 目前找到的utxo余额足够支付，直接return
-					return utxos, totalAmount
-				}
-			}
+	bc.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket([]byte(heightBucket)).Get(Uint64ToByte(height)); data != nil {
+			hash = append([]byte{}, data...)
 		}
+		return nil
+	})
+
+	if hash == nil {
+		return nil, fmt.Errorf("block at height %d not found", height)
 	}
+	return bc.GetBlockByHash(hash)
+}
 
-	return utxos, totalAmount
+// 找到指定锁定脚本(由地址生成，参考AddressToScript)的所有的UTXO，直接查询UTXO集合
+func (bc *BlockChain) FindUTXOs(lockingScript []byte) []*TxOutput {
+	return UTXOSet{bc}.FindUTXO(lockingScript)
 }
 
-func (bc *BlockChain) FindUTXOTransactions(pubKeyHash []byte) ([]*Transaction, map[string]struct{}) {
-	var txs = make([]*Transaction, 0, 8)
-	var spentOutputs = make(map[string]struct{})
-	// 1. 遍历区块
-	// 2. 遍历交易
-	// 3. 遍历output，找到和自己相关的UTXO
-	// 4. 遍历input，找到自己花费过的UTXO(把自己消耗过的给标识出来)
+// 找到指定锁定脚本(可以有多个)的所有UTXO及其outpoint，直接查询UTXO集合
+func (bc *BlockChain) FindCoins(lockingScripts ...[]byte) []*Coin {
+	return UTXOSet{bc}.FindCoins(lockingScripts...)
+}
 
+// 从最后一个区块往前校验整个区块链
+//  1. 每个区块都要通过pow校验，从旧版本迁移过来的区块除外，参考isMigratedBlock
+//  2. 区块的Hash必须和它在数据库中的key一致，也就是后一个区块的PrevHash
+//  3. 最后必须能走到创世块
+//  @return int 校验通过的区块数量
+//  @return error 第一个不合法的区块的错误信息
+func (bc *BlockChain) VerifyChain() (int, error) {
+	count := 0
 	it := bc.NewIterator()
 	for {
+		expectedHash := it.currentHashPointer
 		block := it.Next()
+		if block == nil {
+			return count, fmt.Errorf("block %x not found", expectedHash)
+		}
 
-		for _, tx := range block.Transactions {
-			for _, output := range tx.TxOutputs {
-				// 这个output和我们的目标地址相同，加到返回的txs切片中
-				if bytes.Equal(pubKeyHash, output.PubKeyHash) {
-					txs = append(txs, tx)
-					break
-				}
-			}
-
-			// 如果当前交易是挖矿交易的话，那么不做遍历，直接跳过
-			if tx.IsCoinBase() {
-				continue
-			}
+		if !bytes.Equal(block.Hash, expectedHash) {
+			return count, fmt.Errorf("block %x: prev hash linkage broken, stored hash is %x", expectedHash, block.Hash)
+		}
 
-			//map[交易id:索引下标]struct{}
-			for _, input := range tx.TxInputs {
-				// 判断一下当前这个input和目标地址是否一致，如果相同说明是消耗过的output 则加进来
-				if bytes.Equal(HashPubKey(input.PubKey), pubKeyHash) {
-					key := fmt.Sprintf("%x:%d", input.TxID, input.Index)
-					spentOutputs[key] = struct{}{}
-				}
+		// 迁移过的区块按新的格式已经无法重新校验，只检查链接关系
+		if !bc.isMigrated(block.Hash) {
+			err := NewProofOfWork(block).Validate()
+			if err != nil {
+				return count, fmt.Errorf("block %x: %v", block.Hash, err)
 			}
 		}
+		count++
 
 		if len(block.PrevHash) == 0 {
 			break
 		}
 	}
 
-	return txs, spentOutputs
+	return count, nil
+}
+
+// 找到交易的input引用的所有交易，map[hex(TxID)]交易，只查找主链
+func (bc *BlockChain) FindPrevTxs(tx *Transaction) (map[string]*Transaction, error) {
+	prevTxs := make(map[string]*Transaction)
+	for _, input := range tx.TxInputs {
+		key := hex.EncodeToString(input.TxID)
+		if _, ok := prevTxs[key]; ok {
+			continue
+		}
+		prevTx, err := bc.FindTransactionByTxid(input.TxID)
+		if err != nil {
+			return nil, err
+		}
+		prevTxs[key] = prevTx
+	}
+	return prevTxs, nil
 }
 
 // 根据id查找交易本身，需要遍历整个区块链
@@ -225,43 +373,90 @@ func (bc *BlockChain) FindTransactionByTxid(txID []byte) (*Transaction, error) {
 	return nil, errors.New("invalid txid, not found tx")
 }
 
-// 签名交易
-func (bc *BlockChain) SignTransaction(tx *Transaction, privateKey *ecdsa.PrivateKey) {
-	prevTxs := make(map[string]*Transaction)
-	// 找到所有引用的交易
-	// 1. 根据inputs来找，有多少input就遍历多少次
-	// 2. 找到目标交易
-	// 3. 添加到prevTxs里面
-	for _, input := range tx.TxInputs {
-		// 根据id查找交易本身，需要遍历整个区块链
-		tx, err := bc.FindTransactionByTxid(input.TxID)
-		if err != nil {
-			log.Panic(err)
+// 找到链上所有output的锁定脚本，不管有没有被花费，map[string(锁定脚本)]
+//  恢复HD钱包时用来判断地址有没有用过，需要遍历整个区块链
+func (bc *BlockChain) FindUsedScripts() map[string]bool {
+	used := make(map[string]bool)
+
+	it := bc.NewIterator()
+	for {
+		block := it.Next()
+
+		for _, tx := range block.Transactions {
+			for _, output := range tx.TxOutputs {
+				used[string(output.ScriptPubKey)] = true
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
 		}
-		prevTxs[string(input.TxID)] = tx
 	}
-	tx.Sign(privateKey, prevTxs)
+
+	return used
 }
 
+// 根据交易id查找所在的区块，需要遍历整个区块链
+func (bc *BlockChain) FindBlockByTxid(txID []byte) (*Block, error) {
+	it := bc.NewIterator()
+	for {
+		block := it.Next()
+
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.TxID, txID) {
+				return block, nil
+			}
+		}
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return nil, errors.New("invalid txid, not found tx")
+}
+
+// 签名交易，从UTXO集合中找到所有input引用的output
+func (bc *BlockChain) SignTransaction(tx *Transaction, privateKey *ecdsa.PrivateKey) {
+	prevOutputs, err := UTXOSet{bc}.FindPrevOutputs(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx.Sign(privateKey, prevOutputs)
+}
+
+// 计算交易的交易费，input引用的output必须都在UTXO集合中
+func (bc *BlockChain) TxFee(tx *Transaction) (int64, error) {
+	if tx.IsCoinBase() {
+		return 0, nil
+	}
+	prevOutputs, err := UTXOSet{bc}.FindPrevOutputs(tx)
+	if err != nil {
+		return 0, err
+	}
+	return tx.Fee(prevOutputs)
+}
+
+// 校验交易，input引用的output必须都在UTXO集合中，引用的挖矿交易output必须已经成熟
+//  交易可能来自其他节点，找不到引用的output时校验失败，而不是panic
 func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
 
 	if tx.IsCoinBase() {
 		return true
 	}
 
-	prevTxs := make(map[string]*Transaction)
-	// 找到所有引用的交易
-	// 1. 根据inputs来找，有多少input就遍历多少次
-	// 2. 找到目标交易
-	// 3. 添加到prevTxs里面
-	for _, input := range tx.TxInputs {
-		// 根据id查找交易本身，需要遍历整个区块链
-		tx, err := bc.FindTransactionByTxid(input.TxID)
-		if err != nil {
-			log.Panic(err)
-		}
-		prevTxs[string(input.TxID)] = tx
+	// 交易最早被打包进下一个区块，引用的挖矿交易output到时候必须已经成熟
+	err := UTXOSet{bc}.CheckCoinbaseMaturity(tx, bc.GetBestHeight()+1)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+
+	prevOutputs, err := UTXOSet{bc}.FindPrevOutputs(tx)
+	if err != nil {
+		log.Println(err)
+		return false
 	}
 
-	return tx.Verify(prevTxs)
+	return tx.Verify(prevOutputs)
 }
@@ -30,6 +30,9 @@ func (it *BlockChainIterator) Next() *Block {
 			log.Panic("bucket must be not nil")
 		}
 		blockTmp := bucket.Get(it.currentHashPointer)
+		if blockTmp == nil {
+			return nil
+		}
 		// 解码动作
 		block = Deserialize(blockTmp)
 		// 游标hash左移
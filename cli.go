@@ -1,10 +1,13 @@
 package main
 
 import (
+	"encoding/csv"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // 用来接收命令行参数并且控制区块链操作
@@ -12,16 +15,67 @@ import (
 const Usage = `
     printChain                      "print all blockchain data"
     printTxs                        "print all Transactions"
-    newWallet                       "create new a wallet"
+    newWallet                       "derive the next address of the HD wallet, create the mnemonic at the first time"
+    restoreWallet --mnemonic "WORDS" [--gap N]  "restore the HD wallet from the mnemonic, scan the blockchain for used addresses"
     listAddress                     "query all wallet addresses"
-    getBalance --address ADDRESS    "get address balance"
-    send FROM TO AMOUNT MINER DATA  "send coin to one, the Miner write data"
+    getBalance --address ADDRESS    "get confirmed, immature and spendable balance of the address"
+    getBalance --all                "get balances of all addresses in the wallet"
+    send FROM TO AMOUNT MINER DATA [--fee FEE] [--strategy STRATEGY]  "send coin to one, the Miner write data"
+    send FROM TO AMOUNT [--fee FEE] [--strategy STRATEGY]  "create a tx and put it into the mempool"
+    sendMany FROM --to ADDR:AMOUNT,... [MINER DATA] [--fee FEE] [--strategy STRATEGY]  "pay many addresses in one tx"
+    sendMany FROM --file FILE [MINER DATA] [--fee FEE] [--strategy STRATEGY]  "pay the ADDR,AMOUNT lines of a csv FILE in one tx"
+    sendFromWallet --to ADDR:AMOUNT,... [MINER DATA] [--change ADDR] [--fee FEE] [--strategy STRATEGY]  "pay from all wallet addresses, change goes to a new address by default"
+    sendFromWallet --file FILE [MINER DATA] [--change ADDR] [--fee FEE] [--strategy STRATEGY]  "pay the csv FILE from all wallet addresses"
+    mine --miner ADDR               "pack all pending txs in the mempool into one block, or mine an empty block if there are none"
+    reindexUTXO                     "rebuild the UTXO set from blockchain"
+    verifyChain                     "verify proof of work and linkage of all blocks"
+    supply                          "print issued coins and the max supply"
+    merkleProof --txid TXID         "print the merkle proof of a transaction"
+    getBlock --height HEIGHT        "print the block at the height"
+    getBlock --hash HASH            "print the block with the hash"
+    startNode --port PORT [--miner ADDR]  "start a p2p node, if miner is set mine pending txs every 30s or once 10 txs are pending"
+    sendTx FROM TO AMOUNT NODE [--fee FEE] [--strategy STRATEGY]  "create a tx and relay it to the node at NODE (host:port)"
+    exportKey --address ADDRESS     "print the private key of the address in WIF"
+    importKey --wif WIF [--rescan]  "import a WIF private key, rescan the blockchain for its unspent outputs"
+    importAddress --address ADDRESS  "watch the address without its private key"
+    importPubKey --pubkey PUBKEY    "watch the address of the public key without its private key"
+    encryptWallet                   "encrypt the private keys in wallet.dat with a passphrase"
+    unlockWallet [--timeout SECONDS]  "unlock the wallet for signing, default 300 seconds, prints the WALLET_SESSION to set"
+    lockWallet                      "lock the wallet"
+    changePassphrase                "change the passphrase of the wallet"
+    getPubKey --address ADDRESS     "print the public key of a wallet address"
+    newMultiSig --m M --pubkeys PUBKEY1,PUBKEY2,...  "create a M-of-N multisig address, N is at most 15"
+    createTx FROM TO AMOUNT --out FILE [--fee FEE] [--strategy STRATEGY]  "create an unsigned tx with the txs it spends, no private key needed"
+    signTx --in FILE [--out FILE]   "add signatures of this wallet to the tx in FILE, works offline"
+    broadcastTx --in FILE [--node NODE]  "assemble the signed tx in FILE, put it into the mempool or relay it to NODE"
+
+    STRATEGY chooses the unspent outputs to spend, default bnb:
+        largest   "spend the largest outputs first, fewest inputs"
+        smallest  "spend the smallest outputs first, consolidate small outputs"
+        bnb       "find outputs that match the amount exactly without change, fall back to largest"
+        random    "pick outputs randomly, then improve so the change is close to the amount"
+
+    Coinbase outputs can be spent after 100 blocks, set COINBASE_MATURITY to change it on all nodes.
+    The subsidy starts at 12.5 BTC and halves every 210000 blocks, set INITIAL_SUBSIDY and HALVING_INTERVAL to change them on all nodes.
 `
 
 type CLI struct {
 	bc *BlockChain
 }
 
+// 只需要钱包、不需要区块链数据的命令，离线的机器上没有区块链数据，不能去创建
+var offlineCommands = []string{"newWallet", "listAddress", "getPubKey", "newMultiSig", "signTx",
+	"encryptWallet", "unlockWallet", "lockWallet", "changePassphrase", "exportKey",
+	"importAddress", "importPubKey"}
+
+// 命令是否需要打开区块链，importKey只有rescan时才需要
+func NeedBlockChain(args []string) bool {
+	if len(args) >= 2 && args[1] == "importKey" {
+		return containsString(args, "--rescan")
+	}
+	return len(args) < 2 || !containsString(offlineCommands, args[1])
+}
+
 // 接收参数按情况执行
 func (cli *CLI) Run() {
 	// 1. 得到命令
@@ -43,28 +97,466 @@ func (cli *CLI) Run() {
 		if len(args) == 4 && args[2] == "--address" {
 			addr := args[3]
 			cli.GetBalance(addr)
+		} else if len(args) == 3 && args[2] == "--all" {
+			cli.GetBalanceAll()
 		} else {
 			log.Println("missing params")
 			fmt.Printf(Usage)
 		}
 	case "send":
-		if len(args) != 7 {
+		args, fee, err := parseFee(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		args, strategy, err := parseStrategy(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if len(args) != 7 && len(args) != 5 {
 			log.Println("missing params")
 			fmt.Printf(Usage)
 			return
 		}
-		// send FROM TO AMOUNT MINER DATA
+		// send FROM TO AMOUNT [MINER DATA] [--fee FEE] [--strategy STRATEGY]
 		from := args[2]
 		to := args[3]
-		amount, _ := strconv.ParseFloat(args[4], 64)
+		amount, err := ParseAmount(args[4])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		payments := []*Payment{{To: to, Amount: amount}}
+		if len(args) == 5 {
+			cli.SendPending(from, payments, fee, strategy)
+			return
+		}
 		miner := args[5]
 		data := args[6]
-		cli.Send(from, to, amount, miner, data)
+		cli.Send(from, payments, fee, strategy, miner, data)
+	case "sendMany":
+		args, fee, err := parseFee(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		args, strategy, err := parseStrategy(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		// sendMany FROM (--to ADDR:AMOUNT,... | --file FILE) [MINER DATA] [--fee FEE] [--strategy STRATEGY]
+		rest, options, err := parseOptions(args, "--to", "--file")
+		if err != nil || (len(rest) != 3 && len(rest) != 5) || (options["--to"] == "") == (options["--file"] == "") {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		payments, err := paymentsFromOptions(options)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if len(rest) == 3 {
+			cli.SendPending(rest[2], payments, fee, strategy)
+			return
+		}
+		cli.Send(rest[2], payments, fee, strategy, rest[3], rest[4])
+	case "sendFromWallet":
+		args, fee, err := parseFee(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		args, strategy, err := parseStrategy(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		// sendFromWallet (--to ADDR:AMOUNT,... | --file FILE) [MINER DATA] [--change ADDR] [--fee FEE] [--strategy STRATEGY]
+		rest, options, err := parseOptions(args, "--to", "--file", "--change")
+		if err != nil || (len(rest) != 2 && len(rest) != 4) || (options["--to"] == "") == (options["--file"] == "") {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		payments, err := paymentsFromOptions(options)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		miner, data := "", ""
+		if len(rest) == 4 {
+			miner, data = rest[2], rest[3]
+		}
+		cli.SendFromWallet(payments, fee, strategy, options["--change"], miner, data)
+	case "mine":
+		if len(args) == 4 && args[2] == "--miner" {
+			cli.Mine(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "startNode":
+		// startNode --port PORT [--miner ADDR]
+		if len(args) == 4 && args[2] == "--port" {
+			cli.StartNode(args[3], "")
+		} else if len(args) == 6 && args[2] == "--port" && args[4] == "--miner" {
+			cli.StartNode(args[3], args[5])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "sendTx":
+		args, fee, err := parseFee(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		args, strategy, err := parseStrategy(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		if len(args) != 6 {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		// sendTx FROM TO AMOUNT NODE [--fee FEE] [--strategy STRATEGY]
+		amount, err := ParseAmount(args[4])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		cli.SendTx(args[2], args[3], amount, fee, strategy, args[5])
 	case "newWallet":
 		cli.NewWallet()
 	case "listAddress":
 		cli.ListAddress()
+	case "restoreWallet":
+		// restoreWallet --mnemonic "WORDS" [--gap N]
+		rest, options, err := parseOptions(args, "--mnemonic", "--gap")
+		if err != nil || len(rest) != 2 || options["--mnemonic"] == "" {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		gap := uint64(DefaultGapLimit)
+		if options["--gap"] != "" {
+			gap, err = strconv.ParseUint(options["--gap"], 10, 32)
+			if err != nil || gap == 0 {
+				log.Printf("gap %s is invalid\n", options["--gap"])
+				return
+			}
+		}
+		cli.RestoreWallet(options["--mnemonic"], uint32(gap))
+	case "exportKey":
+		if len(args) == 4 && args[2] == "--address" {
+			cli.ExportKey(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "importKey":
+		// importKey --wif WIF [--rescan]
+		rest, options, err := parseOptions(args, "--wif")
+		rest, rescan := parseFlag(rest, "--rescan")
+		if err != nil || len(rest) != 2 || options["--wif"] == "" {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		cli.ImportKey(options["--wif"], rescan)
+	case "importAddress":
+		if len(args) == 4 && args[2] == "--address" {
+			cli.ImportAddress(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "importPubKey":
+		if len(args) == 4 && args[2] == "--pubkey" {
+			cli.ImportPubKey(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "encryptWallet":
+		cli.EncryptWallet()
+	case "unlockWallet":
+		// unlockWallet [--timeout SECONDS]
+		rest, options, err := parseOptions(args, "--timeout")
+		if err != nil || len(rest) != 2 {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		seconds := uint64(300)
+		if options["--timeout"] != "" {
+			seconds, err = strconv.ParseUint(options["--timeout"], 10, 32)
+			if err != nil || seconds == 0 {
+				log.Printf("timeout %s is invalid\n", options["--timeout"])
+				return
+			}
+		}
+		cli.UnlockWallet(time.Duration(seconds) * time.Second)
+	case "lockWallet":
+		cli.LockWallet()
+	case "changePassphrase":
+		cli.ChangePassphrase()
+	case "reindexUTXO":
+		cli.ReindexUTXO()
+	case "verifyChain":
+		cli.VerifyChain()
+	case "supply":
+		cli.Supply()
+	case "getBlock":
+		if len(args) == 4 && args[2] == "--height" {
+			height, err := strconv.ParseUint(args[3], 10, 64)
+			if err != nil {
+				log.Printf("height %s is invalid\n", args[3])
+				return
+			}
+			cli.GetBlockByHeight(height)
+		} else if len(args) == 4 && args[2] == "--hash" {
+			cli.GetBlockByHash(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "merkleProof":
+		if len(args) == 4 && args[2] == "--txid" {
+			cli.MerkleProof(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "getPubKey":
+		if len(args) == 4 && args[2] == "--address" {
+			cli.GetPubKey(args[3])
+		} else {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+		}
+	case "newMultiSig":
+		rest, options, err := parseOptions(args, "--m", "--pubkeys")
+		if err != nil || len(rest) != 2 || options["--m"] == "" || options["--pubkeys"] == "" {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		m, err := strconv.Atoi(options["--m"])
+		if err != nil {
+			log.Printf("m %s is invalid\n", options["--m"])
+			return
+		}
+		cli.NewMultiSig(m, strings.Split(options["--pubkeys"], ","))
+	case "createTx":
+		args, fee, err := parseFee(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		args, strategy, err := parseStrategy(args)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		rest, options, err := parseOptions(args, "--out")
+		if err != nil || len(rest) != 5 || options["--out"] == "" {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		// createTx FROM TO AMOUNT --out FILE [--fee FEE] [--strategy STRATEGY]
+		amount, err := ParseAmount(rest[4])
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		cli.CreateTx(rest[2], rest[3], amount, fee, strategy, options["--out"])
+	case "signTx":
+		rest, options, err := parseOptions(args, "--in", "--out")
+		if err != nil || len(rest) != 2 || options["--in"] == "" {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		out := options["--out"]
+		if out == "" {
+			out = options["--in"]
+		}
+		cli.SignTx(options["--in"], out)
+	case "broadcastTx":
+		// broadcastTx --in FILE [--node NODE]
+		rest, options, err := parseOptions(args, "--in", "--node")
+		if err != nil || len(rest) != 2 || options["--in"] == "" {
+			log.Println("missing params")
+			fmt.Printf(Usage)
+			return
+		}
+		cli.BroadcastTx(options["--in"], options["--node"])
 	default:
 		fmt.Printf(Usage)
 	}
 }
+
+// 从参数中取出所有指定名字的--name VALUE，返回去掉这些参数后剩下的参数和map[名字]值
+func parseOptions(args []string, names ...string) ([]string, map[string]string, error) {
+	rest := make([]string, 0, len(args))
+	options := make(map[string]string)
+	for i := 0; i < len(args); i++ {
+		if !containsString(names, args[i]) {
+			rest = append(rest, args[i])
+			continue
+		}
+		if i+1 >= len(args) {
+			return nil, nil, fmt.Errorf("missing value of %s", args[i])
+		}
+		options[args[i]] = args[i+1]
+		i++
+	}
+	return rest, options, nil
+}
+
+// 从参数中取出没有值的开关--name，返回去掉它之后剩下的参数和是否指定了这个开关
+func parseFlag(args []string, name string) ([]string, bool) {
+	rest := make([]string, 0, len(args))
+	found := false
+	for _, arg := range args {
+		if arg == name {
+			found = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	return rest, found
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 从参数中取出可选的--fee FEE，返回去掉这两个参数后剩下的参数，不指定时交易费为0
+//  FEE和AMOUNT一样是十进制的BTC，返回的交易费单位是聪
+func parseFee(args []string) ([]string, int64, error) {
+	rest, options, err := parseOptions(args, "--fee")
+	if err != nil {
+		return nil, 0, err
+	}
+	value, ok := options["--fee"]
+	if !ok {
+		return rest, 0, nil
+	}
+	fee, err := ParseAmount(value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("fee %s is invalid: %v", value, err)
+	}
+	return rest, fee, nil
+}
+
+// 从参数中取出可选的--strategy STRATEGY，返回去掉这两个参数后剩下的参数，不指定时用DefaultCoinSelect
+func parseStrategy(args []string) ([]string, string, error) {
+	rest, options, err := parseOptions(args, "--strategy")
+	if err != nil {
+		return nil, "", err
+	}
+	strategy, ok := options["--strategy"]
+	if !ok {
+		return rest, DefaultCoinSelect, nil
+	}
+	if !IsCoinSelectStrategy(strategy) {
+		return nil, "", fmt.Errorf("unknown coin selection strategy %s", strategy)
+	}
+	return rest, strategy, nil
+}
+
+// 解析一个收款方，AMOUNT是十进制的BTC
+func parsePayment(address, amount string) (*Payment, error) {
+	if !IsValidAddress(address) {
+		return nil, fmt.Errorf("address %s is invalid", address)
+	}
+	value, err := ParseAmount(amount)
+	if err != nil {
+		return nil, fmt.Errorf("amount to %s is invalid: %v", address, err)
+	}
+	return &Payment{To: address, Amount: value}, nil
+}
+
+// 收款方来自--to或者--file，两个只能指定一个
+func paymentsFromOptions(options map[string]string) ([]*Payment, error) {
+	if options["--to"] != "" {
+		return parsePayments(options["--to"])
+	}
+	return loadPayments(options["--file"])
+}
+
+// 解析--to ADDR:AMOUNT,ADDR:AMOUNT,...
+func parsePayments(s string) ([]*Payment, error) {
+	var payments []*Payment
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.SplitN(item, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("recipient %s should be ADDR:AMOUNT", item)
+		}
+		payment, err := parsePayment(parts[0], parts[1])
+		if err != nil {
+			return nil, err
+		}
+		payments = append(payments, payment)
+	}
+	return payments, checkDuplicateRecipients(payments)
+}
+
+// 从csv文件读取收款方，每行是ADDR,AMOUNT，#开头的是注释，第一行可以是address,amount的表头
+func loadPayments(file string) ([]*Payment, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("read %s failed: %v", file, err)
+	}
+
+	var payments []*Payment
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(strings.TrimSpace(record[0]), "address") {
+			continue
+		}
+		payment, err := parsePayment(strings.TrimSpace(record[0]), strings.TrimSpace(record[1]))
+		if err != nil {
+			return nil, fmt.Errorf("%s record %d: %v", file, i+1, err)
+		}
+		payments = append(payments, payment)
+	}
+	if len(payments) == 0 {
+		return nil, fmt.Errorf("no recipient in %s", file)
+	}
+	return payments, checkDuplicateRecipients(payments)
+}
+
+// 同一个地址出现两次多半是写错了，不替用户合并
+func checkDuplicateRecipients(payments []*Payment) error {
+	seen := make(map[string]bool)
+	for _, payment := range payments {
+		if seen[payment.To] {
+			return fmt.Errorf("recipient %s appears more than once", payment.To)
+		}
+		seen[payment.To] = true
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// 挖矿交易的解锁脚本
+//  挖矿交易没有引用output，ScriptSig由矿工填写：<区块高度> <ExtraNonce> <标签>，三个都是压入数据的指令
+//  1. 高度放在最前面(BIP34)，不同区块的挖矿交易一定不同
+//  2. ExtraNonce是随机数，同一高度上同一个矿工同一秒创建的挖矿交易也不同，TxID就不会重复
+//  3. 标签由矿工自由填写，例如矿池的名字，printChain中显示
+//  旧版本的挖矿交易直接把数据放在ScriptSig中，创世块为了和已经运行的节点保持一致，也还是旧的格式
+
+const (
+	// 矿工标签的最大长度，BTC的挖矿交易ScriptSig最长100字节
+	maxCoinbaseTagLength = 80
+	// 区块高度最多8个字节
+	coinbaseHeightLength = 8
+
+	// 挖矿交易的output默认要经过的区块数，和BTC一样
+	DefaultCoinbaseMaturity = 100
+	coinbaseMaturityEnv     = "COINBASE_MATURITY"
+)
+
+// 挖矿交易的output在高度h的区块中产生，要到高度h+CoinbaseMaturity的区块中才能被花费
+//  分叉切换时挖矿交易会失效，花费它的交易也跟着失效，所以要等它足够深
+//  可以用环境变量COINBASE_MATURITY修改，所有节点必须使用相同的值，否则对区块是否有效的判断就不一致了
+var CoinbaseMaturity uint64 = DefaultCoinbaseMaturity
+
+func init() {
+	value, ok := os.LookupEnv(coinbaseMaturityEnv)
+	if !ok {
+		return
+	}
+	maturity, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Panicf("%s %s is invalid", coinbaseMaturityEnv, value)
+	}
+	CoinbaseMaturity = maturity
+}
+
+type CoinbaseData struct {
+	Height     uint64
+	ExtraNonce uint64
+	Tag        []byte
+}
+
+// 编码成挖矿交易的ScriptSig
+func (c *CoinbaseData) Script() []byte {
+	extraNonce := make([]byte, 8)
+	binary.LittleEndian.PutUint64(extraNonce, c.ExtraNonce)
+
+	script := pushInt(int64(c.Height))
+	script = append(script, pushData(extraNonce)...)
+	return append(script, pushData(c.Tag)...)
+}
+
+// 解析挖矿交易的ScriptSig，必须是Script()生成的格式，旧版本的挖矿交易会返回错误
+func ParseCoinbaseScript(script []byte) (*CoinbaseData, error) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return nil, err
+	}
+	if len(ops) != 3 {
+		return nil, fmt.Errorf("coinbase script has %d items, want 3", len(ops))
+	}
+	var items [][]byte
+	for _, op := range ops {
+		data, ok := pushedData(op)
+		if !ok {
+			return nil, errors.New("coinbase script must only push data")
+		}
+		items = append(items, data)
+	}
+
+	height, err := decodeScriptNum(items[0], coinbaseHeightLength)
+	if err != nil || height < 0 {
+		return nil, errors.New("coinbase script has invalid height")
+	}
+	if len(items[1]) != 8 {
+		return nil, errors.New("coinbase script has invalid extra nonce")
+	}
+	c := &CoinbaseData{
+		Height:     uint64(height),
+		ExtraNonce: binary.LittleEndian.Uint64(items[1]),
+		Tag:        items[2],
+	}
+	// 每个数据都必须用最短的写法，同一个内容只有一种编码
+	if !bytes.Equal(c.Script(), script) {
+		return nil, errors.New("coinbase script is not canonical")
+	}
+	return c, nil
+}
+
+// 压入数据的指令压入的数据，OP_1到OP_16压入的是一个字节的数字
+func pushedData(op scriptOp) ([]byte, bool) {
+	if n, ok := smallInt(op.opcode); ok {
+		return []byte{byte(n)}, true
+	}
+	if op.isPush() {
+		return op.data, true
+	}
+	return nil, false
+}
+
+// 挖矿交易中矿工的标签，旧版本的挖矿交易是ScriptSig中的原始数据
+func (tx *Transaction) CoinbaseTag() []byte {
+	if !tx.IsCoinBase() {
+		return nil
+	}
+	scriptSig := tx.TxInputs[0].ScriptSig
+	if c, err := ParseCoinbaseScript(scriptSig); err == nil {
+		return c.Tag
+	}
+	return scriptSig
+}
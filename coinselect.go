@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// 选币策略：转账时从地址的UTXO中选出哪些作为input
+//  1. largest：从大到小选，input最少，交易最小
+//  2. smallest：从小到大选，顺便把零散的小额UTXO花掉
+//  3. bnb：分支限界找一组总额刚好够的UTXO，不需要找零；找不到时退回largest
+//  4. random：随机选够之后继续改进，让找零接近转账金额，钱包中UTXO的大小更均匀
+//  找零小于DustThreshold时不创建找零output，直接算作交易费
+
+const (
+	CoinSelectLargest  = "largest"
+	CoinSelectSmallest = "smallest"
+	CoinSelectBnB      = "bnb"
+	CoinSelectRandom   = "random"
+	// 不指定--strategy时的策略，有刚好够的组合就不找零
+	DefaultCoinSelect = CoinSelectBnB
+
+	// 粉尘阈值，单位是聪，比它小的找零以后花掉时的交易费可能比它本身还多
+	DustThreshold int64 = 546
+	// 分支限界最多搜索的节点数，UTXO很多时避免搜索太久
+	bnbMaxTries = 100000
+)
+
+// 一个可以花费的UTXO
+type Coin struct {
+	TxID   []byte
+	Index  int
+	Amount int64
+	// 锁定脚本，从多个地址选币时用来找到签名的私钥
+	ScriptPubKey []byte
+}
+
+// 选币函数，返回总额不小于target的一组UTXO，选不出来时返回nil
+type CoinSelector func(coins []*Coin, target int64) []*Coin
+
+var coinSelectors = map[string]CoinSelector{
+	CoinSelectLargest:  selectLargestFirst,
+	CoinSelectSmallest: selectSmallestFirst,
+	CoinSelectBnB:      selectBranchAndBound,
+	CoinSelectRandom:   selectRandomImprove,
+}
+
+var coinRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// 策略名是否合法
+func IsCoinSelectStrategy(strategy string) bool {
+	_, ok := coinSelectors[strategy]
+	return ok
+}
+
+// 按策略选出总额不小于target的UTXO
+//  @return []*Coin 选中的UTXO，余额不够时为nil
+//  @return int64 选中的总额，余额不够时是所有UTXO的总额
+func SelectCoins(coins []*Coin, target int64, strategy string) ([]*Coin, int64, error) {
+	selector, ok := coinSelectors[strategy]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown coin selection strategy %s", strategy)
+	}
+	selected := selector(coins, target)
+	if selected == nil {
+		total, err := sumCoins(coins)
+		return nil, total, err
+	}
+	total, err := sumCoins(selected)
+	if err != nil {
+		return nil, 0, err
+	}
+	return selected, total, nil
+}
+
+// 计算UTXO的总额，每个UTXO的金额都必须合法，总额不能超过MaxSupply()
+func sumCoins(coins []*Coin) (int64, error) {
+	var total int64
+	for _, coin := range coins {
+		var err error
+		total, err = AddAmount(total, coin.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("coin %x:%d: %v", coin.TxID, coin.Index, err)
+		}
+	}
+	return total, nil
+}
+
+// 按金额排序，金额相同时按outpoint排序，保证每次选的结果一样
+func sortCoins(coins []*Coin, descending bool) []*Coin {
+	sorted := append([]*Coin{}, coins...)
+	sort.Slice(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.Amount != b.Amount {
+			return (a.Amount > b.Amount) == descending
+		}
+		if c := bytes.Compare(a.TxID, b.TxID); c != 0 {
+			return c < 0
+		}
+		return a.Index < b.Index
+	})
+	return sorted
+}
+
+// 按顺序选，直到总额够了为止
+func selectInOrder(coins []*Coin, target int64) []*Coin {
+	var selected []*Coin
+	var total int64
+	for _, coin := range coins {
+		selected = append(selected, coin)
+		total += coin.Amount
+		if total >= target {
+			return selected
+		}
+	}
+	return nil
+}
+
+func selectLargestFirst(coins []*Coin, target int64) []*Coin {
+	return selectInOrder(sortCoins(coins, true), target)
+}
+
+func selectSmallestFirst(coins []*Coin, target int64) []*Coin {
+	return selectInOrder(sortCoins(coins, false), target)
+}
+
+// 分支限界找一组总额在[target, target+DustThreshold)之间的UTXO
+//  多出来的部分不够一个找零output，直接算作交易费，所以不需要找零
+//  从大到小依次决定每个UTXO选或不选，总额超出范围或者剩下的都选上也不够时剪枝
+//  找到多个时取多出来最少的那个，都找不到时退回largest
+func selectBranchAndBound(coins []*Coin, target int64) []*Coin {
+	sorted := sortCoins(coins, true)
+	// remaining[i]是sorted[i:]的总额
+	remaining := make([]int64, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Amount
+	}
+
+	var best, picked []*Coin
+	bestExcess := DustThreshold
+	tries := 0
+	var search func(i int, total int64)
+	search = func(i int, total int64) {
+		tries++
+		if tries > bnbMaxTries || bestExcess == 0 {
+			return
+		}
+		if total >= target {
+			// 再选更多只会多出来更多
+			if total-target < bestExcess {
+				best = append([]*Coin{}, picked...)
+				bestExcess = total - target
+			}
+			return
+		}
+		if i == len(sorted) || total+remaining[i] < target {
+			return
+		}
+		if total+sorted[i].Amount-target < bestExcess {
+			picked = append(picked, sorted[i])
+			search(i+1, total+sorted[i].Amount)
+			picked = picked[:len(picked)-1]
+		}
+		search(i+1, total)
+	}
+	search(0, 0)
+
+	if best != nil {
+		return best
+	}
+	return selectLargestFirst(coins, target)
+}
+
+// 随机选够target之后继续随机加入UTXO，只要总额更接近2倍的target并且不超过3倍的target
+//  这样找零和转账金额差不多大，以后再转类似的金额时更容易凑出来
+func selectRandomImprove(coins []*Coin, target int64) []*Coin {
+	shuffled := append([]*Coin{}, coins...)
+	coinRand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+
+	var selected []*Coin
+	var total int64
+	i := 0
+	for ; i < len(shuffled) && total < target; i++ {
+		selected = append(selected, shuffled[i])
+		total += shuffled[i].Amount
+	}
+	if total < target {
+		return nil
+	}
+
+	ideal := 2 * target
+	for ; i < len(shuffled); i++ {
+		next := total + shuffled[i].Amount
+		if next > 3*target || absAmount(ideal-next) >= absAmount(ideal-total) {
+			continue
+		}
+		selected = append(selected, shuffled[i])
+		total = next
+	}
+	return selected
+}
+
+func absAmount(amount int64) int64 {
+	if amount < 0 {
+		return -amount
+	}
+	return amount
+}
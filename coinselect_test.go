@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+)
+
+// 每个UTXO都不超过MaxSupply()，总额超过了也不能溢出成一个小数字
+func TestSelectCoinsRejectsOverflowingTotal(t *testing.T) {
+	coins := []*Coin{
+		{TxID: []byte{1}, Index: 0, Amount: MaxSupply()},
+		{TxID: []byte{2}, Index: 0, Amount: MaxSupply()},
+	}
+	for strategy := range coinSelectors {
+		if selected, total, err := SelectCoins(coins, MaxSupply()+1, strategy); err == nil {
+			t.Fatalf("%s: selected %d coins with total %d, want error", strategy, len(selected), total)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
 	"fmt"
 	"log"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -12,16 +16,7 @@ func (cli *CLI) PrintBlockChain() {
 	for {
 		// 返回区块，游标左移
 		block := iterator.Next()
-		date := time.Unix(int64(block.TimeStamp), 0).Format("2006-01-02 15:04:05")
-		fmt.Printf("===== 当前区块高度 %d =====\n", 0)
-		fmt.Printf("终端版本: %d\n", block.Version)
-		fmt.Printf("前区块hash值: %x\n", block.PrevHash)
-		fmt.Printf("梅克尔根hash值: %x\n", block.MerkelRoot)
-		fmt.Printf("块产生时间: %s\n", date)
-		fmt.Printf("块难度: %d\n", block.Difficulty)
-		fmt.Printf("随机数: %d\n", block.Nonce)
-		fmt.Printf("当前区块hash值: %x\n", block.Hash)
-		fmt.Printf("当前区块数据: %s\n", block.Transactions[0].TxInputs[0].PubKey)
+		printBlock(block)
 
 		if len(block.PrevHash) == 0 {
 			break
@@ -29,6 +24,43 @@ func (cli *CLI) PrintBlockChain() {
 	}
 }
 
+func printBlock(block *Block) {
+	date := time.Unix(int64(block.TimeStamp), 0).Format("2006-01-02 15:04:05")
+	fmt.Printf("===== 当前区块高度 %d =====\n", block.Height)
+	fmt.Printf("终端版本: %d\n", block.Version)
+	fmt.Printf("前区块hash值: %x\n", block.PrevHash)
+	fmt.Printf("梅克尔根hash值: %x\n", block.MerkelRoot)
+	fmt.Printf("块产生时间: %s\n", date)
+	fmt.Printf("块难度: %08x\n", block.Difficulty)
+	fmt.Printf("随机数: %d\n", block.Nonce)
+	fmt.Printf("当前区块hash值: %x\n", block.Hash)
+	fmt.Printf("当前区块数据: %s\n", block.Transactions[0].CoinbaseTag())
+}
+
+func (cli *CLI) GetBlockByHeight(height uint64) {
+	block, err := cli.bc.GetBlockByHeight(height)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	printBlock(block)
+}
+
+func (cli *CLI) GetBlockByHash(hashStr string) {
+	hash, err := hex.DecodeString(hashStr)
+	if err != nil {
+		log.Printf("block hash %s is invalid\n", hashStr)
+		return
+	}
+
+	block, err := cli.bc.GetBlockByHash(hash)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	printBlock(block)
+}
+
 func (cli *CLI) PrintTransactions() {
 	bc := cli.bc
 	iterator := bc.NewIterator()
@@ -53,40 +85,597 @@ func (cli *CLI) GetBalance(addr string) {
 		return
 	}
 
-	// 2. 生成公钥hash
-	pubKeyHash := GetPubKeyFromAddress(addr)
-	utxos := cli.bc.FindUTXOs(pubKeyHash)
+	// 挖矿交易的output要成熟之后才能花费，参考CoinbaseMaturity
+	confirmed, immature := UTXOSet{cli.bc}.FindBalance(AddressToScript(addr))
+	log.Printf("%s balance: %s\n", addr, FormatAmount(confirmed))
+	fmt.Printf("  confirmed: %s\n", FormatAmount(confirmed))
+	fmt.Printf("  immature:  %s\n", FormatAmount(immature))
+	fmt.Printf("  spendable: %s\n", FormatAmount(confirmed-immature))
+}
+
+// 钱包中所有地址的余额，只查看的地址单独统计，不能花费
+//  还没有成熟的挖矿交易output也单独统计，成熟之后才算在spendable中
+//  多重签名和只查看的地址也一样，每一类都分别显示其中未成熟的部分
+func (cli *CLI) GetBalanceAll() {
+	wallets := NewWallets()
+	utxoSet := UTXOSet{cli.bc}
+
+	var spendable, immature int64
+	for addr := range wallets.WalletsMap {
+		confirmed, locked := utxoSet.FindBalance(AddressToScript(addr))
+		spendable += confirmed - locked
+		immature += locked
+		printAddressBalance(addr, "", confirmed, locked)
+	}
+	var multisig, multisigImmature int64
+	for addr := range wallets.RedeemScripts {
+		confirmed, locked := utxoSet.FindBalance(AddressToScript(addr))
+		multisig += confirmed
+		multisigImmature += locked
+		printAddressBalance(addr, "multisig", confirmed, locked)
+	}
+	var watchOnly, watchOnlyImmature int64
+	for addr := range wallets.WatchOnly {
+		confirmed, locked := utxoSet.FindBalance(AddressToScript(addr))
+		watchOnly += confirmed
+		watchOnlyImmature += locked
+		printAddressBalance(addr, "watch-only", confirmed, locked)
+	}
+
+	fmt.Printf("spendable: %s\n", FormatAmount(spendable))
+	fmt.Printf("immature: %s\n", FormatAmount(immature))
+	fmt.Printf("multisig: %s (immature %s, spendable %s)\n",
+		FormatAmount(multisig), FormatAmount(multisigImmature), FormatAmount(multisig-multisigImmature))
+	fmt.Printf("watch-only: %s (immature %s, spendable %s)\n",
+		FormatAmount(watchOnly), FormatAmount(watchOnlyImmature), FormatAmount(watchOnly-watchOnlyImmature))
+	fmt.Printf("total: %s\n", FormatAmount(spendable+immature+multisig+watchOnly))
+}
 
-	amount := 0.0
-	for _, utxo := range utxos {
-		amount += utxo.Amount
+// 打印一个地址的余额，kind是地址的类型，有未成熟的挖矿交易output时单独显示
+func printAddressBalance(addr, kind string, confirmed, immature int64) {
+	var notes []string
+	if kind != "" {
+		notes = append(notes, kind)
+	}
+	if immature > 0 {
+		notes = append(notes, "immature "+FormatAmount(immature))
+	}
+	if len(notes) == 0 {
+		fmt.Printf("%s: %s\n", addr, FormatAmount(confirmed))
+		return
+	}
+	fmt.Printf("%s: %s (%s)\n", addr, FormatAmount(confirmed), strings.Join(notes, ", "))
+}
+
+// 创建交易并马上挖矿打包，payments可以有多个收款方，一个区块就能全部转完
+func (cli *CLI) Send(from string, payments []*Payment, fee int64, strategy, miner, data string) {
+	// 1. 创建一个普通交易
+	tx := NewTransaction(from, payments, fee, strategy, cli.bc)
+	if tx == nil {
+		return
+	}
+	cli.mineTx(tx, miner, data)
+}
+
+// 把一个交易和挖矿交易一起打包成区块
+func (cli *CLI) mineTx(tx *Transaction, miner, data string) {
+	// 没有找零的粉尘也算在交易费中，矿工可以一起领取
+	fee, err := cli.bc.TxFee(tx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	// 2. 创建挖矿交易，领取出块奖励和交易费
+	coinbase := NewCoinBaseTx(miner, data, cli.bc.GetBestHeight()+1, fee)
+	if coinbase == nil {
+		return
+	}
+	// 3. 添加到区块，交易池中已经被打包的和冲突的交易一起删掉
+	mempool := NewMempool(cli.bc, true)
+	block := cli.bc.AddBlock([]*Transaction{coinbase, tx})
+	if block == nil {
+		// 交易校验不通过，交易池中如果也有这笔交易，以后也打包不了
+		mempool.Remove(tx.TxID)
+		fmt.Printf("mine tx %x failed, tx dropped\n", tx.TxID)
+		return
+	}
+	mempool.RemoveBlockTxs(block)
+}
+
+func (cli *CLI) StartNode(port, miner string) {
+	if miner != "" && !IsValidAddress(miner) {
+		log.Printf("address %s is invalid\n", miner)
+		return
+	}
+	server := NewServer(cli.bc, port, miner)
+	server.Start()
+}
+
+// 创建交易但不在本地挖矿，而是发给指定的节点
+func (cli *CLI) SendTx(from, to string, amount, fee int64, strategy, node string) {
+	tx := NewTransaction(from, []*Payment{{To: to, Amount: amount}}, fee, strategy, cli.bc)
+	if tx == nil {
+		return
+	}
+	err := SendTxToNode(node, tx)
+	if err != nil {
+		log.Println("send tx failed:", err)
+		return
+	}
+	fmt.Printf("tx %x sent to %s\n", tx.TxID, node)
+}
+
+// 创建交易放到交易池中，等待mine命令打包
+func (cli *CLI) SendPending(from string, payments []*Payment, fee int64, strategy string) {
+	tx := NewTransaction(from, payments, fee, strategy, cli.bc)
+	if tx == nil {
+		return
+	}
+	cli.addToMempool(tx)
+}
+
+// 从钱包中所有的地址一起付款，miner为空时放到交易池中，否则马上挖矿打包
+//  change为空时找零发到HD钱包新导出的地址
+func (cli *CLI) SendFromWallet(payments []*Payment, fee int64, strategy, change, miner, data string) {
+	tx := NewWalletTransaction(payments, fee, strategy, change, cli.bc)
+	if tx == nil {
+		return
+	}
+	if miner == "" {
+		cli.addToMempool(tx)
+		return
+	}
+	cli.mineTx(tx, miner, data)
+}
+
+func (cli *CLI) addToMempool(tx *Transaction) {
+	mempool := NewMempool(cli.bc, true)
+	err := mempool.Add(tx)
+	if err != nil {
+		log.Println("add tx to mempool failed:", err)
+		return
 	}
-	log.Printf("%s balance: %f\n", addr, amount)
+	fmt.Printf("tx %x added to mempool, %d pending\n", tx.TxID, mempool.Count())
 }
 
-func (cli *CLI) Send(from, to string, amount float64, miner, data string) {
-	// 1. 创建挖矿交易
-	coinbase := NewCoinBaseTx(miner, data)
-	// 2. 创建一个普通交易
-	tx := NewTransaction(from, to, amount, cli.bc)
-	if coinbase == nil || tx == nil {
+// 把交易池中所有的交易打包成一个区块
+func (cli *CLI) Mine(miner string) {
+	mempool := NewMempool(cli.bc, true)
+	block := MinePendingTxs(cli.bc, mempool, miner, "")
+	if block == nil {
 		return
 	}
-	// 3. 添加到区块
-	cli.bc.AddBlock([]*Transaction{coinbase, tx})
+	fmt.Printf("block %x mined at height %d with %d txs, %d still pending\n",
+		block.Hash, block.Height, len(block.Transactions)-1, mempool.Count())
 }
 
+// 从HD钱包导出下一个地址，第一次执行时生成助记词
 func (cli *CLI) NewWallet() {
 	wallets := NewWallets()
-	address := wallets.CreateWallet()
+	if wallets.HD == nil {
+		mnemonic, err := wallets.InitHD()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		fmt.Println("your wallet mnemonic, write it down and keep it safe, it restores all addresses:")
+		fmt.Println(mnemonic)
+	}
+	address, err := wallets.CreateWallet()
+	if err != nil {
+		log.Println(err)
+		return
+	}
 	fmt.Printf("your new address: %s\n", address)
 }
 
+// 从助记词恢复HD钱包，扫描区块链找回用过的地址
+func (cli *CLI) RestoreWallet(mnemonic string, gap uint32) {
+	used := cli.bc.FindUsedScripts()
+	isUsed := func(address string) bool {
+		return used[string(AddressToScript(address))]
+	}
+
+	wallets := NewWallets()
+	count, err := wallets.Restore(mnemonic, gap, isUsed)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("wallet restored, %d used addresses found\n", count)
+	for address, wallet := range wallets.WalletsMap {
+		if wallet.Path != "" {
+			fmt.Printf("%s: %s\n", wallet.Path, address)
+		}
+	}
+}
+
+// 导出地址的私钥，WIF格式
+func (cli *CLI) ExportKey(addr string) {
+	wallets := NewWallets()
+	wallet := wallets.WalletsMap[addr]
+	if wallet == nil {
+		log.Printf("not found address %s in wallet\n", addr)
+		return
+	}
+	if err := wallets.CheckUnlocked(); err != nil {
+		log.Println(err)
+		return
+	}
+	wif, err := wallet.ExportWIF()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println(wif)
+}
+
+// 导入WIF格式的私钥，rescan时在UTXO集合中查找这个地址已有的output
+func (cli *CLI) ImportKey(wif string, rescan bool) {
+	wallet, err := NewWalletFromWIF(wif)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	address, err := NewWallets().ImportKey(wallet)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("imported address: %s\n", address)
+	if !rescan {
+		return
+	}
+
+	utxos := cli.bc.FindUTXOs(AddressToScript(address))
+	var amount int64
+	for _, utxo := range utxos {
+		amount += utxo.Amount
+	}
+	fmt.Printf("found %d unspent outputs, balance: %s\n", len(utxos), FormatAmount(amount))
+}
+
+// 用密码加密钱包中的私钥
+func (cli *CLI) EncryptWallet() {
+	wallets := NewWallets()
+	if wallets.IsEncrypted() {
+		log.Println("wallet is already encrypted, use changePassphrase")
+		return
+	}
+	passphrase, err := readNewPassphrase()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = wallets.Encrypt(passphrase)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println("wallet encrypted, run unlockWallet before signing")
+}
+
+// 解锁钱包，timeout之后自动锁住
+//  密码从环境变量WALLET_PASSPHRASE或者标准输入读取
+//  打印出会话密钥，只有设置了环境变量WALLET_SESSION的命令才能使用解锁的钱包
+func (cli *CLI) UnlockWallet(timeout time.Duration) {
+	wallets := NewWallets()
+	if !wallets.IsEncrypted() {
+		log.Println("wallet is not encrypted")
+		return
+	}
+	passphrase, ok := os.LookupEnv(passphraseEnv)
+	if !ok {
+		var err error
+		passphrase, err = readPassphrase("passphrase: ")
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	key, err := wallets.Encryption.Unlock(passphrase)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	session, err := saveUnlockKey(wallets.Encryption, key, timeout)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("wallet unlocked for %v, set this in the shell that signs:\n", timeout)
+	fmt.Printf("export %s=%s\n", sessionEnv, session)
+}
+
+// 锁住钱包，删掉unlockWallet保存的密钥
+func (cli *CLI) LockWallet() {
+	err := removeUnlockKey()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println("wallet locked")
+}
+
+// 修改钱包密码
+func (cli *CLI) ChangePassphrase() {
+	wallets := NewWallets()
+	if !wallets.IsEncrypted() {
+		log.Println("wallet is not encrypted, use encryptWallet")
+		return
+	}
+	oldPassphrase, err := readPassphrase("old passphrase: ")
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	newPassphrase, err := readNewPassphrase()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	err = wallets.ChangePassphrase(oldPassphrase, newPassphrase)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println("passphrase changed, wallet locked")
+}
+
 func (cli *CLI) ListAddress() {
 	wallets := NewWallets()
 	addresses := wallets.GetAllAddress()
 	fmt.Println("Tips: the order of all list addresses is random!")
 	for i, addr := range addresses {
+		if path := wallets.WalletsMap[addr].Path; path != "" {
+			fmt.Printf("wallet[%d]: %s (%s)\n", i, addr, path)
+			continue
+		}
 		fmt.Printf("wallet[%d]: %s\n", i, addr)
 	}
+	i := 0
+	for addr, redeemScript := range wallets.RedeemScripts {
+		m, pubKeys, _ := ParseMultiSigScript(redeemScript)
+		fmt.Printf("multisig[%d]: %s (%d-of-%d)\n", i, addr, m, len(pubKeys))
+		i++
+	}
+	i = 0
+	for addr := range wallets.WatchOnly {
+		fmt.Printf("watch[%d]: %s (watch-only)\n", i, addr)
+		i++
+	}
+}
+
+// 添加只查看的地址
+func (cli *CLI) ImportAddress(addr string) {
+	err := NewWallets().AddWatchOnly(addr, nil)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("watch-only address: %s\n", addr)
+}
+
+// 添加只查看的公钥，公钥也可以用来创建多重签名地址
+func (cli *CLI) ImportPubKey(pubKeyStr string) {
+	pubKey, err := hex.DecodeString(pubKeyStr)
+	if err != nil {
+		log.Printf("pubkey %s is invalid\n", pubKeyStr)
+		return
+	}
+	if _, err := parsePubKeyOnAnyCurve(pubKey); err != nil {
+		log.Printf("pubkey %s is invalid: %v\n", pubKeyStr, err)
+		return
+	}
+
+	addr := PubKeyHashToAddr(HashPubKey(pubKey))
+	err = NewWallets().AddWatchOnly(addr, pubKey)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("watch-only address: %s\n", addr)
+}
+
+func (cli *CLI) ReindexUTXO() {
+	utxoSet := UTXOSet{cli.bc}
+	utxoSet.Reindex()
+	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", utxoSet.CountTransactions())
+}
+
+func (cli *CLI) VerifyChain() {
+	count, err := cli.bc.VerifyChain()
+	if err != nil {
+		fmt.Printf("blockchain is invalid, %d blocks verified before the first invalid one\n", count)
+		fmt.Printf("invalid block: %v\n", err)
+		return
+	}
+	fmt.Printf("blockchain is valid, %d blocks verified\n", count)
+}
+
+func (cli *CLI) MerkleProof(txIDStr string) {
+	txID, err := hex.DecodeString(txIDStr)
+	if err != nil {
+		log.Printf("txid %s is invalid\n", txIDStr)
+		return
+	}
+
+	block, err := cli.bc.FindBlockByTxid(txID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	proof, err := block.MerkleProof(txID)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	fmt.Printf("交易: %x\n", txID)
+	fmt.Printf("所在区块hash值: %x\n", block.Hash)
+	fmt.Printf("梅克尔根hash值: %x\n", block.MerkelRoot)
+	for i, node := range proof {
+		side := "right"
+		if node.IsLeft {
+			side = "left"
+		}
+		fmt.Printf("proof[%d]: %x (%s)\n", i, node.Hash, side)
+	}
+	fmt.Printf("校验结果: %v\n", VerifyMerkleProof(txID, proof, block.MerkelRoot))
+}
+
+// 打印已经产生的币和理论上的总量上限
+//  矿工可以少领出块奖励，所以UTXO集合中实际流通的币可能比已产生的少
+func (cli *CLI) Supply() {
+	height := cli.bc.GetBestHeight()
+	issued := IssuedSupply(height)
+	maxSupply := MaxSupply()
+
+	fmt.Printf("当前高度: %d\n", height)
+	fmt.Printf("当前出块奖励: %s\n", FormatAmount(Subsidy(height)))
+	fmt.Printf("下一次减半高度: %d\n", (height/HalvingInterval+1)*HalvingInterval)
+	fmt.Printf("已产生: %s\n", FormatAmount(issued))
+	fmt.Printf("实际流通: %s\n", FormatAmount(UTXOSet{cli.bc}.TotalAmount()))
+	fmt.Printf("总量上限: %s (%.4f%%)\n", FormatAmount(maxSupply), float64(issued)/float64(maxSupply)*100)
+}
+
+// 打印钱包地址的公钥，用于创建多重签名地址
+func (cli *CLI) GetPubKey(addr string) {
+	wallet := NewWallets().WalletsMap[addr]
+	if wallet == nil {
+		log.Printf("not found address %s in wallet\n", addr)
+		return
+	}
+	fmt.Printf("%x\n", wallet.PubKey)
+}
+
+// 创建多重签名地址，保存到钱包中
+//  所有参与者都要用相同的m和公钥顺序执行一次，才能在各自的钱包中签名
+func (cli *CLI) NewMultiSig(m int, pubKeyStrs []string) {
+	var pubKeys [][]byte
+	for _, str := range pubKeyStrs {
+		pubKey, err := hex.DecodeString(str)
+		if err != nil || len(pubKey) == 0 {
+			log.Printf("pubkey %s is invalid\n", str)
+			return
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	address, err := NewWallets().AddMultiSig(m, pubKeys)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("your new %d-of-%d multisig address: %s\n", m, len(pubKeys), address)
+}
+
+// 创建一个还没有签名的交易，连同引用的output一起保存到文件中
+//  不需要from的私钥，可以在只有区块链数据的联网机器上创建，再拿到离线的机器上签名
+func (cli *CLI) CreateTx(from, to string, amount, fee int64, strategy, file string) {
+	tx := NewUnsignedTransaction(from, []*Payment{{To: to, Amount: amount}}, fee, strategy, cli.bc)
+	if tx == nil {
+		return
+	}
+	prevTxs, err := cli.bc.FindPrevTxs(tx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	ptx, err := NewPartialTx(tx, NewWallets(), prevTxs)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = ptx.SaveToFile(file)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("unsigned tx %x saved to %s\n", tx.TxID, file)
+}
+
+// 用钱包中的私钥给文件中的交易签名，不需要区块链数据
+//  签名前打印交易的output和交易费，签名的人可以确认交易内容
+func (cli *CLI) SignTx(in, out string) {
+	ptx, err := LoadPartialTx(in)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Println(ptx.Tx)
+	fee, err := ptx.Tx.Fee(ptx.PrevOutputs())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	fmt.Printf("fee: %s\n", FormatAmount(fee))
+
+	count, err := ptx.Sign(NewWallets())
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	err = ptx.SaveToFile(out)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	fmt.Printf("added %d signatures to tx %x, saved to %s\n", count, ptx.Tx.TxID, out)
+	for i := range ptx.Inputs {
+		have, need := ptx.SignatureCount(i)
+		fmt.Printf("input[%d]: %d of %d signatures\n", i, have, need)
+	}
+}
+
+// 组装文件中已经签好名的交易，校验通过后放到交易池中，指定node时发给这个节点
+//  文件中的output是创建交易时保存的，要和当前的UTXO集合对比，防止被花费或者被篡改
+func (cli *CLI) BroadcastTx(file, node string) {
+	ptx, err := LoadPartialTx(file)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	prevOutputs, err := UTXOSet{cli.bc}.FindPrevOutputs(ptx.Tx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	filePrevOutputs := ptx.PrevOutputs()
+	for i, input := range ptx.Tx.TxInputs {
+		key := outpointKey(input.TxID, input.Index)
+		if prevOutputs[key].Amount != filePrevOutputs[key].Amount ||
+			!bytes.Equal(prevOutputs[key].ScriptPubKey, filePrevOutputs[key].ScriptPubKey) {
+			log.Printf("input %d: output in %s does not match the utxo set\n", i, file)
+			return
+		}
+	}
+	tx, err := ptx.Finalize()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if node != "" {
+		err = SendTxToNode(node, tx)
+		if err != nil {
+			log.Println("send tx failed:", err)
+			return
+		}
+		fmt.Printf("tx %x sent to %s\n", tx.TxID, node)
+		return
+	}
+
+	mempool := NewMempool(cli.bc, true)
+	err = mempool.Add(tx)
+	if err != nil {
+		log.Println("add tx to mempool failed:", err)
+		return
+	}
+	fmt.Printf("tx %x added to mempool, %d pending\n", tx.TxID, mempool.Count())
 }
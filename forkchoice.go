@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"math/big"
+)
+
+// 分叉选择：所有区块不管是否接在主链最后，都按hash保存下来，同时记录每个区块的累计工作量
+//  哪条链的累计工作量最大，哪条就是主链，新区块使另一条链的工作量超过主链时进行重组：
+//  1. 从主链最后一个区块开始往前回滚，直到两条链的分叉点，回滚每个区块对UTXO集合的修改
+//  2. 从分叉点开始依次连接新链上的区块，重新校验交易并更新UTXO集合
+//  整个过程在同一个db.Update事务中完成，中途出错会整体回滚，主链保持不变
+
+// 父区块不存在的区块，需要先同步它前面的区块
+var ErrOrphanBlock = errors.New("orphan block, parent not found")
+
+// 在事务中根据hash读取区块
+func getBlock(tx *bolt.Tx, hash []byte) (*Block, error) {
+	data := tx.Bucket([]byte(blockChainBucket)).Get(hash)
+	if data == nil {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	return Deserialize(data), nil
+}
+
+// 在事务中根据高度读取主链上的区块
+func getBlockByHeight(tx *bolt.Tx, height uint64) (*Block, error) {
+	hash := tx.Bucket([]byte(heightBucket)).Get(Uint64ToByte(height))
+	if hash == nil {
+		return nil, fmt.Errorf("block at height %d not found", height)
+	}
+	return getBlock(tx, hash)
+}
+
+// 在事务中读取区块的累计工作量
+func getWork(tx *bolt.Tx, hash []byte) *big.Int {
+	return new(big.Int).SetBytes(tx.Bucket([]byte(workBucket)).Get(hash))
+}
+
+// 重建主链上每个区块的累计工作量，旧版本的数据库没有记录
+func (bc *BlockChain) reindexWork() {
+	bestHeight := bc.GetBestHeight()
+
+	err := bc.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(workBucket))
+		if err != nil {
+			return err
+		}
+
+		work := new(big.Int)
+		for height := uint64(0); height <= bestHeight; height++ {
+			block, err := getBlockByHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			work.Add(work, BlockWork(block.Difficulty))
+			err = bucket.Put(block.Hash, work.Bytes())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 处理一个新区块，本地挖出来的和其他节点发来的都走这里
+//  1. 父区块必须存在，区块本身要通过checkBlock校验，侧链上的区块也一样，校验通过才保存
+//  2. 保存区块和它的累计工作量
+//  3. 累计工作量超过当前主链时，直接接到主链后面或者进行重组
+//  @return []*Transaction 重组时从主链上断开的区块中的交易，按在链上的顺序排列，需要放回交易池
+func (bc *BlockChain) ProcessBlock(block *Block) ([]*Transaction, error) {
+	if _, err := bc.GetBlockByHash(block.Hash); err == nil {
+		return nil, fmt.Errorf("block %x already exists", block.Hash)
+	}
+
+	parent, err := bc.GetBlockByHash(block.PrevHash)
+	if err != nil {
+		return nil, ErrOrphanBlock
+	}
+
+	err = bc.checkBlock(block, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	var newTail []byte
+	var disconnected []*Transaction
+	err = bc.db.Update(func(tx *bolt.Tx) error {
+		work := new(big.Int).Add(getWork(tx, parent.Hash), BlockWork(block.Difficulty))
+		err := tx.Bucket([]byte(blockChainBucket)).Put(block.Hash, block.Serialize())
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket([]byte(workBucket)).Put(block.Hash, work.Bytes())
+		if err != nil {
+			return err
+		}
+
+		// 工作量没有超过主链，只保存在分叉上
+		if work.Cmp(getWork(tx, bc.tail)) <= 0 {
+			log.Printf("block %x saved on a side chain at height %d\n", block.Hash, block.Height)
+			return nil
+		}
+
+		if bytes.Equal(block.PrevHash, bc.tail) {
+			err = bc.connectBlock(tx, block)
+		} else {
+			disconnected, err = bc.reorganize(tx, block)
+		}
+		if err != nil {
+			return err
+		}
+		newTail = block.Hash
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// 事务提交成功之后再修改内存中的tail
+	if newTail != nil {
+		bc.tail = newTail
+	}
+	return disconnected, nil
+}
+
+// 不依赖UTXO集合的区块校验
+//  1. 高度和难度值必须和父区块对应
+//  2. 通过pow校验
+//  3. 第一笔交易必须是挖矿交易，并且只能有一笔挖矿交易
+//  4. 挖矿交易的ScriptSig中必须是区块的高度，保证不同区块的挖矿交易TxID不同
+//  5. 每笔交易的TxID不能被篡改，也不能重复，梅克尔根必须和交易一致
+//     梅克尔树在奇数层复制最后一个节点，最后几笔交易重复一遍的区块hash和原来的区块一样(CVE-2012-2459)
+//     这样的区块如果保存下来，就会占住正常区块的hash，正常区块就再也加不进来了
+//  6. 每个output的金额都在[0, MaxSupply()]之间，同一个output在区块中只能被花费一次
+func (bc *BlockChain) checkBlock(block, parent *Block) error {
+	if block.Height != parent.Height+1 {
+		return fmt.Errorf("block %x has invalid height %d", block.Hash, block.Height)
+	}
+	if block.Difficulty != bc.nextDifficulty(parent) {
+		return fmt.Errorf("block %x has invalid difficulty %08x", block.Hash, block.Difficulty)
+	}
+
+	err := NewProofOfWork(block).Validate()
+	if err != nil {
+		return fmt.Errorf("block %x: %v", block.Hash, err)
+	}
+
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("block %x has no tx", block.Hash)
+	}
+	if !bytes.Equal(block.MakeMerkelRoot(), block.MerkelRoot) {
+		return fmt.Errorf("block %x has invalid merkle root", block.Hash)
+	}
+
+	txIDs := make(map[string]bool)
+	spent := make(map[string]bool)
+	for i, tx := range block.Transactions {
+		if tx.IsCoinBase() != (i == 0) {
+			return fmt.Errorf("block %x: the first and only the first tx must be coinbase", block.Hash)
+		}
+		if i == 0 {
+			c, err := ParseCoinbaseScript(tx.TxInputs[0].ScriptSig)
+			if err != nil {
+				return fmt.Errorf("block %x: %v", block.Hash, err)
+			}
+			if c.Height != block.Height {
+				return fmt.Errorf("block %x: coinbase height %d, want %d", block.Hash, c.Height, block.Height)
+			}
+		}
+		if !bytes.Equal(tx.CalcHash(), tx.TxID) {
+			return fmt.Errorf("block %x: tx %x has invalid txid", block.Hash, tx.TxID)
+		}
+		if txIDs[string(tx.TxID)] {
+			return fmt.Errorf("block %x: duplicate tx %x", block.Hash, tx.TxID)
+		}
+		txIDs[string(tx.TxID)] = true
+
+		var total int64
+		for j, output := range tx.TxOutputs {
+			total, err = AddAmount(total, output.Amount)
+			if err != nil {
+				return fmt.Errorf("block %x: tx %x output %d: %v", block.Hash, tx.TxID, j, err)
+			}
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, input := range tx.TxInputs {
+			key := outpointKey(input.TxID, input.Index)
+			if spent[key] {
+				return fmt.Errorf("block %x: output %s is spent twice", block.Hash, key)
+			}
+			spent[key] = true
+		}
+	}
+	return nil
+}
+
+// 把区块接到主链的最后，逐笔校验交易脚本并更新UTXO集合，同时记录回滚数据和高度索引
+//  交易必须已经过了LockTime，引用的output也要满足相对时间锁，引用的挖矿交易output必须已经成熟
+//  交易按顺序处理，后面的交易可以花费同一个区块中前面交易的output
+//  挖矿交易的金额不能超过这个高度的出块奖励加上所有交易的交易费，每个output都不能是负数
+//  从旧版本迁移过来的区块无法重新校验签名，参考isMigratedBlock
+func (bc *BlockChain) connectBlock(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(utxoBucket))
+	undo := &BlockUndo{}
+	var fees int64
+	migrated := isMigratedBlock(tx, block.Hash)
+
+	for _, t := range block.Transactions {
+		if !t.IsCoinBase() {
+			if !t.IsFinal(block.Height, block.TimeStamp) {
+				return fmt.Errorf("block %x: tx %x is locked until %d", block.Hash, t.TxID, t.LockTime)
+			}
+			err := sequenceLocksInBucket(bucket, t, block.Height)
+			if err != nil {
+				return fmt.Errorf("block %x: tx %x: %v", block.Hash, t.TxID, err)
+			}
+			err = coinbaseMaturityInBucket(bucket, t, block.Height)
+			if err != nil {
+				return fmt.Errorf("block %x: tx %x: %v", block.Hash, t.TxID, err)
+			}
+			prevOutputs, err := prevOutputsInBucket(bucket, t)
+			if err != nil {
+				return fmt.Errorf("block %x: tx %x: %v", block.Hash, t.TxID, err)
+			}
+			if !migrated && !t.Verify(prevOutputs) {
+				return fmt.Errorf("block %x: tx %x verify failed", block.Hash, t.TxID)
+			}
+			fee, err := t.Fee(prevOutputs)
+			if err != nil {
+				return fmt.Errorf("block %x: %v", block.Hash, err)
+			}
+			fees, err = AddAmount(fees, fee)
+			if err != nil {
+				return fmt.Errorf("block %x: fees: %v", block.Hash, err)
+			}
+		}
+
+		err := applyTx(bucket, t, block.Height, undo)
+		if err != nil {
+			return fmt.Errorf("block %x: tx %x: %v", block.Hash, t.TxID, err)
+		}
+	}
+
+	// 挖矿交易的output和普通交易一样，每个都在[0, MaxSupply()]之间，求和时不能溢出
+	var coinbaseAmount int64
+	for i, output := range block.Transactions[0].TxOutputs {
+		var err error
+		coinbaseAmount, err = AddAmount(coinbaseAmount, output.Amount)
+		if err != nil {
+			return fmt.Errorf("block %x: coinbase output %d: %v", block.Hash, i, err)
+		}
+	}
+	subsidy := Subsidy(block.Height)
+	if coinbaseAmount > subsidy+fees {
+		return fmt.Errorf("block %x: coinbase pays %s, more than subsidy %s plus fees %s",
+			block.Hash, FormatAmount(coinbaseAmount), FormatAmount(subsidy), FormatAmount(fees))
+	}
+
+	err := tx.Bucket([]byte(undoBucket)).Put(block.Hash, undo.Serialize())
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(heightBucket)).Put(Uint64ToByte(block.Height), block.Hash)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(blockChainBucket)).Put([]byte(lastHashKey), block.Hash)
+}
+
+// 把主链的最后一个区块断开，回滚它对UTXO集合的修改
+func (bc *BlockChain) disconnectBlock(tx *bolt.Tx, block *Block) error {
+	err := UTXOSet{bc}.Rollback(tx, block)
+	if err != nil {
+		return err
+	}
+	err = tx.Bucket([]byte(heightBucket)).Delete(Uint64ToByte(block.Height))
+	if err != nil {
+		return err
+	}
+	return tx.Bucket([]byte(blockChainBucket)).Put([]byte(lastHashKey), block.PrevHash)
+}
+
+// 重组，把主链切换到以newTip结尾的分叉上
+//  @return []*Transaction 断开的区块中除了挖矿交易之外的交易，按在原来主链上的顺序排列
+func (bc *BlockChain) reorganize(tx *bolt.Tx, newTip *Block) ([]*Transaction, error) {
+	oldBlock, err := getBlock(tx, bc.tail)
+	if err != nil {
+		return nil, err
+	}
+	newBlock := newTip
+
+	// 新链上需要连接的区块，从后往前存
+	var attach []*Block
+	// 断开的区块，也是从后往前存
+	var detach []*Block
+
+	// 1. 两条链先走到同一个高度
+	for newBlock.Height > oldBlock.Height {
+		attach = append(attach, newBlock)
+		newBlock, err = getBlock(tx, newBlock.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for oldBlock.Height > newBlock.Height {
+		err = bc.disconnectBlock(tx, oldBlock)
+		if err != nil {
+			return nil, err
+		}
+		detach = append(detach, oldBlock)
+		oldBlock, err = getBlock(tx, oldBlock.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. 同时往前走，直到分叉点
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		err = bc.disconnectBlock(tx, oldBlock)
+		if err != nil {
+			return nil, err
+		}
+		detach = append(detach, oldBlock)
+		attach = append(attach, newBlock)
+
+		oldBlock, err = getBlock(tx, oldBlock.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+		newBlock, err = getBlock(tx, newBlock.PrevHash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 3. 从分叉点开始依次连接新链上的区块
+	for i := len(attach) - 1; i >= 0; i-- {
+		err = bc.connectBlock(tx, attach[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 4. 断开的区块中的交易不能丢，按原来的顺序返回，由调用者放回交易池
+	var txs []*Transaction
+	for i := len(detach) - 1; i >= 0; i-- {
+		txs = append(txs, detach[i].Transactions[1:]...)
+	}
+
+	log.Printf("reorganize at fork point %x (height %d): %d blocks disconnected, %d blocks connected\n",
+		oldBlock.Hash, oldBlock.Height, len(detach), len(attach))
+	return txs, nil
+}
+
+// 生成区块定位器：主链上从最后一个区块往前的一组hash，越往前间隔越大，最后一个是创世块
+//  对方根据定位器找到两条链的分叉点，只需要发送分叉点之后的区块
+func (bc *BlockChain) BlockLocator() [][]byte {
+	var locator [][]byte
+	height := int64(bc.GetBestHeight())
+	step := int64(1)
+
+	for height > 0 {
+		block, err := bc.GetBlockByHeight(uint64(height))
+		if err != nil {
+			log.Panic(err)
+		}
+		locator = append(locator, block.Hash)
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		height -= step
+	}
+
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		log.Panic(err)
+	}
+	return append(locator, genesis.Hash)
+}
+
+// 根据对方的区块定位器，返回主链上分叉点之后的区块hash，按高度从低到高排列，最多返回max个
+func (bc *BlockChain) HashesAfterLocator(locator [][]byte, max int) [][]byte {
+	var forkHeight uint64
+	for _, hash := range locator {
+		block, err := bc.GetBlockByHash(hash)
+		if err != nil {
+			continue
+		}
+		// 必须是主链上的区块
+		mainBlock, err := bc.GetBlockByHeight(block.Height)
+		if err == nil && bytes.Equal(mainBlock.Hash, hash) {
+			forkHeight = block.Height
+			break
+		}
+	}
+
+	var hashes [][]byte
+	bestHeight := bc.GetBestHeight()
+	for height := forkHeight + 1; height <= bestHeight && len(hashes) < max; height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			log.Panic(err)
+		}
+		hashes = append(hashes, block.Hash)
+	}
+	return hashes
+}
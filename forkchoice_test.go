@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// 在临时目录中创建区块链，创世块的出块奖励给w
+func newTestBlockChain(t *testing.T, w *Wallet) *BlockChain {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(t.TempDir())
+	bc := NewBlockChain(w.NewAddress())
+	t.Cleanup(func() {
+		bc.db.Close()
+		os.Chdir(dir)
+	})
+	return bc
+}
+
+// 接在parent后面挖一个区块，不经过ProcessBlock
+func mineTestBlock(bc *BlockChain, parent *Block, txs ...*Transaction) *Block {
+	coinbase := NewCoinBaseTx(NewWallet().NewAddress(), "", parent.Height+1, 0)
+	return NewBlock(append([]*Transaction{coinbase}, txs...), parent.Hash, parent.Height+1, bc.nextDifficulty(parent))
+}
+
+// 最后一笔交易重复一遍，梅克尔根不变，区块hash也不变，侧链上的这种区块也不能保存
+func TestProcessBlockRejectsDuplicateTxs(t *testing.T) {
+	bc := newTestBlockChain(t, NewWallet())
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.ProcessBlock(mineTestBlock(bc, genesis)); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := NewWallet().NewAddress()
+	var txs []*Transaction
+	for i := 0; i < 2; i++ {
+		tx := &Transaction{
+			TxInputs:  []*TxInput{{TxID: bytes.Repeat([]byte{byte(i + 1)}, 32), Index: 0}},
+			TxOutputs: []*TxOutput{NewTxOutput(100, addr)},
+		}
+		tx.TxID = tx.CalcHash()
+		txs = append(txs, tx)
+	}
+	mutated := mineTestBlock(bc, genesis, txs[0], txs[1], txs[1])
+	valid := &Block{Transactions: mutated.Transactions[:3]}
+	if !bytes.Equal(valid.MakeMerkelRoot(), mutated.MerkelRoot) {
+		t.Fatal("merkle root of the mutated block should equal the original one")
+	}
+
+	if _, err := bc.ProcessBlock(mutated); err == nil {
+		t.Fatal("block with duplicate txs accepted")
+	}
+	if _, err := bc.GetBlockByHash(mutated.Hash); err == nil {
+		t.Fatal("block with duplicate txs stored")
+	}
+}
+
+// 区块中后面的交易可以花费前面交易的output，反过来不行
+func TestProcessBlockWithChainedTxs(t *testing.T) {
+	maturity := CoinbaseMaturity
+	CoinbaseMaturity = 0
+	defer func() { CoinbaseMaturity = maturity }()
+
+	w := NewWallet()
+	bc := newTestBlockChain(t, w)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := NewWallet()
+	parent := newChildTx(w, genesis.Transactions[0], 0, 0, to.NewAddress())
+	child := newChildTx(to, parent, 0, 0, NewWallet().NewAddress())
+
+	if _, err := bc.ProcessBlock(mineTestBlock(bc, genesis, child, parent)); err == nil {
+		t.Fatal("block spending a later tx accepted")
+	}
+	if _, err := bc.ProcessBlock(mineTestBlock(bc, genesis, parent, child)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 重组时断开的区块中的交易要放回交易池
+func TestReorganizeReturnsDisconnectedTxs(t *testing.T) {
+	maturity := CoinbaseMaturity
+	CoinbaseMaturity = 0
+	defer func() { CoinbaseMaturity = maturity }()
+
+	w := NewWallet()
+	bc := newTestBlockChain(t, w)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := newChildTx(w, genesis.Transactions[0], 0, 0, NewWallet().NewAddress())
+	if _, err := bc.ProcessBlock(mineTestBlock(bc, genesis, tx)); err != nil {
+		t.Fatal(err)
+	}
+
+	// 分叉上的两个区块没有这笔交易，工作量超过主链之后重组
+	side := mineTestBlock(bc, genesis)
+	disconnected, err := bc.ProcessBlock(side)
+	if err != nil || disconnected != nil {
+		t.Fatalf("side block: %v, %d txs disconnected", err, len(disconnected))
+	}
+	disconnected, err = bc.ProcessBlock(mineTestBlock(bc, side))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disconnected) != 1 || !bytes.Equal(disconnected[0].TxID, tx.TxID) {
+		t.Fatalf("%d txs disconnected, want tx %x", len(disconnected), tx.TxID)
+	}
+
+	mp := NewMempool(bc, false)
+	mp.AddDisconnectedTxs(disconnected)
+	if !mp.Has(tx.TxID) {
+		t.Fatal("disconnected tx is not back in the mempool")
+	}
+}
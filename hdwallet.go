@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil/hdkeychain"
+	"github.com/tyler-smith/go-bip39"
+)
+
+// 分层确定性钱包(HD钱包)
+//  1. 第一次newWallet时生成BIP39助记词，助记词导出种子，种子就是整个钱包的备份
+//  2. 每个地址的私钥都是从种子按BIP44的路径m/44'/0'/0'/0/i导出的，i从0开始递增
+//  3. 用restoreWallet --mnemonic从助记词恢复钱包，扫描区块链找回用过的地址
+
+const (
+	// 助记词的熵长度，128位对应12个单词
+	mnemonicEntropyBits = 128
+	// 恢复钱包时连续这么多个地址都没有用过，就认为后面的也没有用过
+	DefaultGapLimit = 20
+)
+
+// BIP44的路径：m/purpose'/coin_type'/account'/change/address_index
+var hdAccountPath = []uint32{
+	hdkeychain.HardenedKeyStart + 44,
+	hdkeychain.HardenedKeyStart + 0,
+	hdkeychain.HardenedKeyStart + 0,
+	0,
+}
+
+type HDWallet struct {
+	// BIP39种子，钱包加密之后只保存加密的种子，锁住时为nil
+	seed          []byte
+	encryptedSeed []byte
+	// 下一个要导出的地址序号
+	NextIndex uint32
+}
+
+// wallet.dat中保存的HD钱包
+type hdWalletData struct {
+	Seed          []byte
+	EncryptedSeed []byte
+	NextIndex     uint32
+}
+
+// 生成新的助记词
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// 从助记词创建HD钱包，助记词必须合法(单词在词表中，校验和正确)
+func NewHDWallet(mnemonic string) (*HDWallet, error) {
+	seed, err := bip39.NewSeedWithErrorChecking(mnemonic, "")
+	if err != nil {
+		return nil, fmt.Errorf("invalid mnemonic: %v", err)
+	}
+	return &HDWallet{seed: seed}, nil
+}
+
+func hdPath(index uint32) string {
+	return fmt.Sprintf("m/44'/0'/0'/0/%d", index)
+}
+
+// 导出第index个地址的钱包
+func (hd *HDWallet) Derive(index uint32) (*Wallet, error) {
+	if hd.seed == nil {
+		return nil, ErrWalletLocked
+	}
+	key, err := hdkeychain.NewMaster(hd.seed, &chaincfg.MainNetParams)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range append(hdAccountPath, index) {
+		key, err = key.Derive(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	privateKey, err := key.ECPrivKey()
+	if err != nil {
+		return nil, err
+	}
+	return &Wallet{
+		Private: (*ecdsa.PrivateKey)(privateKey),
+		PubKey:  privateKey.PubKey().SerializeCompressed(),
+		Curve:   CurveSecp256k1,
+		Path:    hdPath(index),
+	}, nil
+}
+
+// 导出下一个地址的钱包
+//  极小概率某个序号导出的私钥不合法，BIP32规定跳过这个序号
+func (hd *HDWallet) Next() (*Wallet, error) {
+	for {
+		index := hd.NextIndex
+		hd.NextIndex++
+		wallet, err := hd.Derive(index)
+		if err == hdkeychain.ErrInvalidChild {
+			continue
+		}
+		return wallet, err
+	}
+}
+
+func (hd *HDWallet) encrypt(key []byte) error {
+	encryptedSeed, err := encryptSecret(key, hd.seed, nil)
+	if err != nil {
+		return err
+	}
+	hd.encryptedSeed = encryptedSeed
+	return nil
+}
+
+func (hd *HDWallet) decrypt(key []byte) error {
+	seed, err := decryptSecret(key, hd.encryptedSeed, nil)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	hd.seed = seed
+	return nil
+}
+
+func (hd *HDWallet) GobEncode() ([]byte, error) {
+	data := hdWalletData{
+		EncryptedSeed: hd.encryptedSeed,
+		NextIndex:     hd.NextIndex,
+	}
+	if hd.encryptedSeed == nil {
+		data.Seed = hd.seed
+	}
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(data)
+	return buffer.Bytes(), err
+}
+
+func (hd *HDWallet) GobDecode(data []byte) error {
+	var hdData hdWalletData
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&hdData)
+	if err != nil {
+		return err
+	}
+	*hd = HDWallet{
+		seed:          hdData.Seed,
+		encryptedSeed: hdData.EncryptedSeed,
+		NextIndex:     hdData.NextIndex,
+	}
+	return nil
+}
+
+// 给钱包生成助记词，之后newWallet都从助记词导出地址
+//  @return string 助记词，只在这里返回一次，钱包中只保存种子
+func (ws *Wallets) InitHD() (string, error) {
+	if ws.HD != nil {
+		return "", errors.New("wallet already has an HD seed")
+	}
+	mnemonic, err := NewMnemonic()
+	if err != nil {
+		return "", err
+	}
+	return mnemonic, ws.setHD(mnemonic)
+}
+
+func (ws *Wallets) setHD(mnemonic string) error {
+	// 加密的钱包要用密钥加密种子
+	err := ws.CheckUnlocked()
+	if err != nil {
+		return err
+	}
+	hd, err := NewHDWallet(mnemonic)
+	if err != nil {
+		return err
+	}
+	ws.HD = hd
+
+	ws.saveWallets()
+	return nil
+}
+
+// 从助记词恢复钱包
+//  按顺序导出地址，用isUsed判断地址在链上有没有用过，连续gap个地址都没用过就停止
+//  最后一个用过的地址之前的所有地址都加到钱包中
+//  @return int 恢复的地址数量
+func (ws *Wallets) Restore(mnemonic string, gap uint32, isUsed func(address string) bool) (int, error) {
+	if ws.HD != nil {
+		return 0, errors.New("wallet already has an HD seed")
+	}
+	err := ws.setHD(mnemonic)
+	if err != nil {
+		return 0, err
+	}
+
+	var found []*Wallet
+	// 最后一个用过的地址之后的NextIndex，以及到它为止的地址数量
+	var usedNext uint32
+	usedCount := 0
+	for unused := uint32(0); unused < gap; {
+		wallet, err := ws.HD.Next()
+		if err != nil {
+			return 0, err
+		}
+		found = append(found, wallet)
+		if isUsed(wallet.NewAddress()) {
+			usedNext = ws.HD.NextIndex
+			usedCount = len(found)
+			unused = 0
+		} else {
+			unused++
+		}
+	}
+
+	ws.HD.NextIndex = usedNext
+	for _, wallet := range found[:usedCount] {
+		ws.WalletsMap[wallet.NewAddress()] = wallet
+	}
+
+	ws.saveWallets()
+	return usedCount, nil
+}
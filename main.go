@@ -1,7 +1,11 @@
 package main
 
+import "os"
+
 func main() {
-	bc := NewBlockChain("1HhH22Ugs1yap3oaAdnnLiFbrEVj45pHwC")
-	cli := &CLI{bc: bc}
+	cli := &CLI{}
+	if NeedBlockChain(os.Args) {
+		cli.bc = NewBlockChain("1HhH22Ugs1yap3oaAdnnLiFbrEVj45pHwC")
+	}
 	cli.Run()
 }
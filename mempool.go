@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"time"
+)
+
+const mempoolBucket = "mempoolBucket"
+
+// 交易池，保存已经签名、校验通过但还没有被打包的交易
+//  矿工从交易池中取出所有交易打包成一个区块
+type Mempool struct {
+	bc *BlockChain
+	// map[hex(TxID)]*Transaction
+	txs map[string]*Transaction
+	// 被交易池中的交易花费的output，map["TxID:index"]花费它的hex(TxID)
+	spent map[string]string
+	// 是否持久化到数据库，命令行每次执行都是一个新进程，需要持久化才能在send之后mine
+	persist bool
+}
+
+func outpointKey(txID []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txID, index)
+}
+
+// 创建交易池，persist为true时从数据库中加载之前保存的交易
+func NewMempool(bc *BlockChain, persist bool) *Mempool {
+	mp := &Mempool{
+		bc:      bc,
+		txs:     make(map[string]*Transaction),
+		spent:   make(map[string]string),
+		persist: persist,
+	}
+	if !persist {
+		return mp
+	}
+
+	bc.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(mempoolBucket))
+		if err != nil {
+			log.Panic(err)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			t, err := DeserializeTransaction(v)
+			if err != nil {
+				log.Panic(err)
+			}
+			mp.addToMap(t)
+			return nil
+		})
+	})
+	return mp
+}
+
+func (mp *Mempool) addToMap(tx *Transaction) {
+	txID := hex.EncodeToString(tx.TxID)
+	mp.txs[txID] = tx
+	for _, input := range tx.TxInputs {
+		mp.spent[outpointKey(input.TxID, input.Index)] = txID
+	}
+}
+
+// 添加交易到交易池
+//  1. 不能是挖矿交易，TxID不能被篡改，签名必须校验通过
+//  2. 引用的output必须在UTXO集合中，或者是交易池中其他交易的output
+//  3. 引用的output不能已经被交易池中的其他交易花费
+//  4. 交易的时间锁必须已经解除，可以被打包进下一个区块
+func (mp *Mempool) Add(tx *Transaction) error {
+	txID := hex.EncodeToString(tx.TxID)
+	if mp.txs[txID] != nil {
+		return fmt.Errorf("tx %s already in mempool", txID)
+	}
+	if tx.IsCoinBase() {
+		return errors.New("coinbase tx can not be added to mempool")
+	}
+	if !bytes.Equal(tx.CalcHash(), tx.TxID) {
+		return fmt.Errorf("tx %s has invalid txid", txID)
+	}
+
+	inputs := make(map[string]struct{})
+	for _, input := range tx.TxInputs {
+		key := outpointKey(input.TxID, input.Index)
+		if _, ok := inputs[key]; ok {
+			return fmt.Errorf("tx %s spends output %s twice", txID, key)
+		}
+		inputs[key] = struct{}{}
+
+		if other, ok := mp.spent[key]; ok {
+			return fmt.Errorf("tx %s double spend: output %s is already spent by pending tx %s", txID, key, other)
+		}
+	}
+
+	_, err := mp.verify(tx)
+	if err != nil {
+		return fmt.Errorf("tx %s: %v", txID, err)
+	}
+
+	mp.addToMap(tx)
+	if mp.persist {
+		mp.bc.db.Update(func(t *bolt.Tx) error {
+			return t.Bucket([]byte(mempoolBucket)).Put(tx.TxID, tx.Serialize())
+		})
+	}
+	return nil
+}
+
+func (mp *Mempool) Get(txID []byte) *Transaction {
+	return mp.txs[hex.EncodeToString(txID)]
+}
+
+func (mp *Mempool) Has(txID []byte) bool {
+	return mp.Get(txID) != nil
+}
+
+func (mp *Mempool) Count() int {
+	return len(mp.txs)
+}
+
+// 返回交易池中所有的交易，父交易排在花费它的output的交易前面
+func (mp *Mempool) Transactions() []*Transaction {
+	var txs []*Transaction
+	for _, tx := range mp.txs {
+		txs = append(txs, tx)
+	}
+	return sortByDependency(txs)
+}
+
+// 按依赖关系排序，父交易排在花费它的output的交易前面，没有依赖关系的交易保持原来的顺序
+func sortByDependency(txs []*Transaction) []*Transaction {
+	index := make(map[string]*Transaction)
+	for _, tx := range txs {
+		index[hex.EncodeToString(tx.TxID)] = tx
+	}
+
+	var sorted []*Transaction
+	visited := make(map[string]bool)
+	var visit func(tx *Transaction)
+	visit = func(tx *Transaction) {
+		txID := hex.EncodeToString(tx.TxID)
+		if visited[txID] {
+			return
+		}
+		visited[txID] = true
+		for _, input := range tx.TxInputs {
+			if parent, ok := index[hex.EncodeToString(input.TxID)]; ok {
+				visit(parent)
+			}
+		}
+		sorted = append(sorted, tx)
+	}
+	for _, tx := range txs {
+		visit(tx)
+	}
+	return sorted
+}
+
+// 查找交易引用的output，UTXO集合中没有的再到交易池中找
+//  @return map[string]*TxOutput input引用的output
+//  @return *Transaction 只包含引用链上output的input，用来检查挖矿交易是否成熟和相对时间锁
+func (mp *Mempool) findPrevOutputs(tx *Transaction) (map[string]*TxOutput, *Transaction, error) {
+	prevOutputs := make(map[string]*TxOutput)
+	confirmed := &Transaction{}
+	for _, input := range tx.TxInputs {
+		key := outpointKey(input.TxID, input.Index)
+		if output, ok := (UTXOSet{mp.bc}).FindOutput(input.TxID, input.Index); ok {
+			prevOutputs[key] = output
+			confirmed.TxInputs = append(confirmed.TxInputs, input)
+			continue
+		}
+
+		parent := mp.Get(input.TxID)
+		if parent == nil || input.Index < 0 || input.Index >= len(parent.TxOutputs) {
+			return nil, nil, fmt.Errorf("output %s is not in utxo set or mempool", key)
+		}
+		// 父交易最早和这笔交易打包进同一个区块，相对时间锁只能为0
+		if input.Sequence&SequenceLockDisableFlag == 0 && input.Sequence&SequenceLockMask != 0 {
+			return nil, nil, fmt.Errorf("output %s is in mempool, relative lock can not be satisfied", key)
+		}
+		prevOutputs[key] = parent.TxOutputs[input.Index]
+	}
+	return prevOutputs, confirmed, nil
+}
+
+// 校验交易能否被打包进下一个区块，返回input引用的output
+//  1. 引用的output必须在UTXO集合或者交易池中
+//  2. 交易的时间锁必须已经解除，引用的链上output的相对时间锁也必须已经解除
+//  3. 引用的挖矿交易output必须已经成熟
+//  4. 签名必须校验通过
+func (mp *Mempool) verify(tx *Transaction) (map[string]*TxOutput, error) {
+	prevOutputs, confirmed, err := mp.findPrevOutputs(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	height := mp.bc.GetBestHeight() + 1
+	if !tx.IsFinal(height, uint64(time.Now().Unix())) {
+		return nil, fmt.Errorf("locked until %d", tx.LockTime)
+	}
+	err = UTXOSet{mp.bc}.CheckSequenceLocks(confirmed, height)
+	if err != nil {
+		return nil, err
+	}
+	err = UTXOSet{mp.bc}.CheckCoinbaseMaturity(confirmed, height)
+	if err != nil {
+		return nil, err
+	}
+	if !tx.Verify(prevOutputs) {
+		return nil, errors.New("verify failed")
+	}
+	return prevOutputs, nil
+}
+
+// 从交易池中删除交易
+func (mp *Mempool) Remove(txID []byte) {
+	key := hex.EncodeToString(txID)
+	tx := mp.txs[key]
+	if tx == nil {
+		return
+	}
+
+	delete(mp.txs, key)
+	for _, input := range tx.TxInputs {
+		delete(mp.spent, outpointKey(input.TxID, input.Index))
+	}
+	if mp.persist {
+		mp.bc.db.Update(func(t *bolt.Tx) error {
+			return t.Bucket([]byte(mempoolBucket)).Delete(txID)
+		})
+	}
+}
+
+// 区块上链之后，删掉已经被打包的交易，以及和区块中的交易冲突(花费了同一个output)的交易
+func (mp *Mempool) RemoveBlockTxs(block *Block) {
+	for _, tx := range block.Transactions {
+		mp.Remove(tx.TxID)
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, input := range tx.TxInputs {
+			if other, ok := mp.spent[outpointKey(input.TxID, input.Index)]; ok {
+				otherID, _ := hex.DecodeString(other)
+				mp.Remove(otherID)
+			}
+		}
+	}
+}
+
+// 重组时从主链上断开的区块中的交易放回交易池
+//  按依赖关系的顺序添加，花费断开的交易的output的交易要等父交易放回去之后才能通过校验
+//  已经被新主链打包的、和新主链冲突的交易校验不通过，直接丢弃
+func (mp *Mempool) AddDisconnectedTxs(txs []*Transaction) {
+	for _, tx := range sortByDependency(txs) {
+		if mp.Has(tx.TxID) {
+			continue
+		}
+		err := mp.Add(tx)
+		if err != nil {
+			log.Printf("tx %x from disconnected block dropped: %v\n", tx.TxID, err)
+		}
+	}
+}
+
+// 选出可以打包进下一个区块的交易，父交易排在前面，返回这些交易和交易费总和
+//  打包前重新校验一遍，区块链可能已经变化，失效的交易直接从交易池中删掉
+//  父交易失效被删掉之后，花费它的output的交易也跟着失效
+//  交易费总和溢出时跳过这笔交易，花费它的output的交易也只能一起跳过，都留在交易池中
+func (mp *Mempool) SelectTxs() ([]*Transaction, int64) {
+	var txs []*Transaction
+	var fees int64
+	selected := make(map[string]bool)
+	for _, tx := range mp.Transactions() {
+		prevOutputs, err := mp.verify(tx)
+		if err != nil {
+			log.Printf("tx %x is no longer valid, removed from mempool: %v\n", tx.TxID, err)
+			mp.Remove(tx.TxID)
+			continue
+		}
+		if !mp.parentsSelected(tx, selected) {
+			continue
+		}
+		fee, err := tx.Fee(prevOutputs)
+		if err == nil {
+			fee, err = AddAmount(fees, fee)
+		}
+		if err != nil {
+			log.Printf("tx %x skipped: %v\n", tx.TxID, err)
+			continue
+		}
+		fees = fee
+		selected[hex.EncodeToString(tx.TxID)] = true
+		txs = append(txs, tx)
+	}
+	return txs, fees
+}
+
+// 交易引用的交易池中的交易是否都已经被选中
+func (mp *Mempool) parentsSelected(tx *Transaction, selected map[string]bool) bool {
+	for _, input := range tx.TxInputs {
+		if mp.Has(input.TxID) && !selected[hex.EncodeToString(input.TxID)] {
+			return false
+		}
+	}
+	return true
+}
+
+// 把交易池中所有的交易和挖矿交易一起打包成一个区块，交易池为空时区块中只有挖矿交易
+func MinePendingTxs(bc *BlockChain, mp *Mempool, miner, data string) *Block {
+	txs, fees := mp.SelectTxs()
+	// 交易池是空的也照样出块，只领取出块奖励，否则新链上的挖矿交易永远等不到成熟
+	if len(txs) == 0 {
+		log.Println("no pending tx, mining a block with only the coinbase")
+	}
+
+	// 挖矿交易领取出块奖励和所有交易的交易费
+	coinbase := NewCoinBaseTx(miner, data, bc.GetBestHeight()+1, fees)
+	if coinbase == nil {
+		return nil
+	}
+	// 交易已经校验过，可能花费同一个区块中前面交易的output，不能再按UTXO集合逐个校验
+	block := bc.appendBlock(append([]*Transaction{coinbase}, txs...))
+	if block == nil {
+		return nil
+	}
+
+	mp.RemoveBlockTxs(block)
+	return block
+}
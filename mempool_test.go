@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// 创建一笔花费parent第index个output的交易，全部转给to，留下fee作为交易费
+func newChildTx(w *Wallet, parent *Transaction, index int, fee int64, to string) *Transaction {
+	tx := &Transaction{
+		TxInputs:  []*TxInput{{TxID: parent.TxID, Index: index, Sequence: SequenceFinal}},
+		TxOutputs: []*TxOutput{NewTxOutput(parent.TxOutputs[index].Amount-fee, to)},
+		Timestamp: uint64(time.Now().UnixNano()),
+	}
+	tx.SetHash()
+	tx.Sign(w.Private, map[string]*TxOutput{outpointKey(parent.TxID, index): parent.TxOutputs[index]})
+	return tx
+}
+
+// 交易池中的交易可以花费另一笔还没有打包的交易的output，两笔交易打包进同一个区块
+//  子交易的交易费按父交易的output计算，矿工可以领取两笔交易的交易费
+func TestMempoolChainedSpend(t *testing.T) {
+	maturity := CoinbaseMaturity
+	CoinbaseMaturity = 0
+	defer func() { CoinbaseMaturity = maturity }()
+
+	w := NewWallet()
+	bc := newTestBlockChain(t, w)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	to := NewWallet()
+	parent := newChildTx(w, genesis.Transactions[0], 0, 1, to.NewAddress())
+	child := newChildTx(to, parent, 0, 2, NewWallet().NewAddress())
+
+	mp := NewMempool(bc, false)
+	if err := mp.Add(child); err == nil {
+		t.Fatal("child added before its parent")
+	}
+	if err := mp.Add(parent); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(child); err != nil {
+		t.Fatal(err)
+	}
+	if err := mp.Add(newChildTx(to, parent, 0, 0, NewWallet().NewAddress())); err == nil {
+		t.Fatal("double spend of a mempool output accepted")
+	}
+
+	block := MinePendingTxs(bc, mp, NewWallet().NewAddress(), "")
+	if block == nil || len(block.Transactions) != 3 {
+		t.Fatal("parent and child are not mined in one block")
+	}
+	if amount := block.Transactions[0].TxOutputs[0].Amount; amount != Subsidy(1)+3 {
+		t.Fatalf("coinbase pays %d, want %d", amount, Subsidy(1)+3)
+	}
+	if mp.Count() != 0 {
+		t.Fatalf("%d txs left in mempool", mp.Count())
+	}
+	if _, err := bc.VerifyChain(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 断开的交易不管传进来的顺序如何，父交易都要先放回交易池，子交易才不会被丢掉
+func TestAddDisconnectedTxsInDependencyOrder(t *testing.T) {
+	maturity := CoinbaseMaturity
+	CoinbaseMaturity = 0
+	defer func() { CoinbaseMaturity = maturity }()
+
+	w := NewWallet()
+	bc := newTestBlockChain(t, w)
+	genesis, err := bc.GetBlockByHeight(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := newChildTx(w, genesis.Transactions[0], 0, 0, w.NewAddress())
+	child := newChildTx(w, parent, 0, 0, NewWallet().NewAddress())
+
+	mp := NewMempool(bc, false)
+	mp.AddDisconnectedTxs([]*Transaction{child, parent})
+	if !mp.Has(parent.TxID) || !mp.Has(child.TxID) {
+		t.Fatal("disconnected txs are not back in the mempool")
+	}
+
+	// 父交易被打包之后，子交易引用的output就在UTXO集合中了
+	if _, err := bc.ProcessBlock(mineTestBlock(bc, genesis, parent)); err != nil {
+		t.Fatal(err)
+	}
+	mp.RemoveBlockTxs(&Block{Transactions: []*Transaction{parent}})
+	txs, _ := mp.SelectTxs()
+	if len(txs) != 1 || !bytes.Equal(txs[0].TxID, child.TxID) {
+		t.Fatalf("%d txs selected, want the child", len(txs))
+	}
+}
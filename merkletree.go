@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// 梅克尔树，与比特币一致：
+//  1. 叶子节点就是交易的TxID
+//  2. 父节点 = sha256(sha256(左子节点 + 右子节点))
+//  3. 某一层的节点数量为奇数时，复制最后一个节点凑成偶数
+type MerkleTree struct {
+	// 每一层的节点hash，Levels[0]是叶子层，最后一层只有一个节点，就是梅克尔根
+	Levels [][][]byte
+}
+
+// 梅克尔证明路径上的一个节点：兄弟节点的hash，以及它在左边还是右边
+type MerkleProofNode struct {
+	Hash   []byte
+	IsLeft bool
+}
+
+func DoubleSha256(data []byte) []byte {
+	hash1 := sha256.Sum256(data)
+	hash2 := sha256.Sum256(hash1[:])
+	return hash2[:]
+}
+
+// 计算两个子节点的父节点
+func merkleParent(left, right []byte) []byte {
+	data := make([]byte, 0, len(left)+len(right))
+	data = append(data, left...)
+	data = append(data, right...)
+	return DoubleSha256(data)
+}
+
+// 根据叶子节点，一层一层往上计算，直到只剩一个根节点
+func NewMerkleTree(leaves [][]byte) *MerkleTree {
+	tree := &MerkleTree{}
+	if len(leaves) == 0 {
+		return tree
+	}
+
+	level := make([][]byte, len(leaves))
+	copy(level, leaves)
+	tree.Levels = append(tree.Levels, level)
+
+	for len(level) > 1 {
+		// 奇数个节点，复制最后一个
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, merkleParent(level[i], level[i+1]))
+		}
+		tree.Levels = append(tree.Levels, next)
+		level = next
+	}
+
+	return tree
+}
+
+// 返回梅克尔根，没有叶子节点时返回空
+func (t *MerkleTree) Root() []byte {
+	if len(t.Levels) == 0 {
+		return []byte{}
+	}
+	return t.Levels[len(t.Levels)-1][0]
+}
+
+// 生成指定叶子节点的梅克尔证明，即从叶子到根路径上所有的兄弟节点
+func (t *MerkleTree) Proof(leaf []byte) ([]*MerkleProofNode, error) {
+	if len(t.Levels) == 0 {
+		return nil, fmt.Errorf("empty merkle tree")
+	}
+
+	index := -1
+	for i, node := range t.Levels[0] {
+		if bytes.Equal(node, leaf) {
+			index = i
+			break
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("leaf %x not found in merkle tree", leaf)
+	}
+
+	var proof []*MerkleProofNode
+	// 最后一层是根节点，不需要兄弟节点
+	for _, level := range t.Levels[:len(t.Levels)-1] {
+		var node *MerkleProofNode
+		if index%2 == 0 {
+			sibling := index + 1
+			// 奇数个节点时最后一个节点和自己配对
+			if sibling >= len(level) {
+				sibling = index
+			}
+			node = &MerkleProofNode{Hash: level[sibling], IsLeft: false}
+		} else {
+			node = &MerkleProofNode{Hash: level[index-1], IsLeft: true}
+		}
+		proof = append(proof, node)
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// 校验梅克尔证明：从叶子节点开始，依次和兄弟节点拼接计算父节点，最后结果必须等于梅克尔根
+func VerifyMerkleProof(leaf []byte, proof []*MerkleProofNode, root []byte) bool {
+	hash := leaf
+	for _, node := range proof {
+		if node.IsLeft {
+			hash = merkleParent(node.Hash, hash)
+		} else {
+			hash = merkleParent(hash, node.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
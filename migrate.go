@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+	"math"
+)
+
+// 数据库格式的版本，数据格式不兼容时加1，打开旧版本的数据库时按版本依次迁移
+//  0. 没有版本号的数据库
+//  1. 梅克尔根改成二叉梅克尔树的根，区块的格式不变
+//  2. 区块头中加入Height，按在链上的位置重新计算，更早的区块没有Height字段，读出来都是0
+//  3. 金额改成int64，单位是聪，之前是float64
+//  4. output的PubKeyHash改成锁定脚本，input的Signature和PubKey改成解锁脚本
+//  5. UTXO集合中记录output是否来自挖矿交易，区块的格式不变
+const dbVersion = 5
+
+// 读取数据库格式的版本，旧版本的数据库没有metaBucket，版本为0
+func (bc *BlockChain) getDBVersion() int {
+	version := 0
+	bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(metaBucket))
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get([]byte(dbVersionKey)); data != nil {
+			version = int(data[0])
+		}
+		return nil
+	})
+	return version
+}
+
+func putDBVersion(tx *bolt.Tx, version int) error {
+	bucket, err := tx.CreateBucketIfNotExists([]byte(metaBucket))
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(dbVersionKey), []byte{byte(version)})
+}
+
+// 区块是否是从旧版本迁移过来的
+//  迁移时TxID和区块hash都保持不变，但交易序列化后的数据变了，迁移前的签名已经无法重新校验
+//  这些区块在迁移之前已经校验过，再次上链时(比如分叉切换)只校验金额，不执行脚本
+//  区块头也可能按新的格式无法重新校验(比如梅克尔根的算法变了、补上的高度)，verifyChain时也不再校验pow
+func isMigratedBlock(tx *bolt.Tx, hash []byte) bool {
+	bucket := tx.Bucket([]byte(migratedBucket))
+	return bucket != nil && bucket.Get(hash) != nil
+}
+
+// 在单独的事务中查询区块是否是从旧版本迁移过来的
+func (bc *BlockChain) isMigrated(hash []byte) bool {
+	var migrated bool
+	bc.db.View(func(tx *bolt.Tx) error {
+		migrated = isMigratedBlock(tx, hash)
+		return nil
+	})
+	return migrated
+}
+
+// 按版本依次迁移旧的数据库，必须在其他重建索引的操作之前执行，否则旧格式的区块无法反序列化
+func (bc *BlockChain) migrate() {
+	version := bc.getDBVersion()
+	if version >= dbVersion {
+		return
+	}
+
+	steps := []struct {
+		desc    string
+		migrate func(version int) error
+	}{
+		{"binary merkle tree root", bc.markBlocksMigrated},
+		{"block height from chain position", bc.migrateHeights},
+		{"float64 amounts -> int64 satoshis", func(version int) error {
+			return bc.migrateBlocks(version, convertBlockV2)
+		}},
+		{"pubkey hash -> scripts", func(version int) error {
+			return bc.migrateBlocks(version, convertBlockV3)
+		}},
+		{"coinbase flag in utxo set", bc.dropUTXOSet},
+	}
+	for ; version < dbVersion; version++ {
+		log.Printf("migrating blockchain db to version %d: %s\n", version+1, steps[version].desc)
+		err := steps[version].migrate(version)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+}
+
+// 区块不变，但梅克尔根的算法变了，已有区块的梅克尔根按新的算法无法重新校验
+//  区块hash包含梅克尔根，不能重新计算，所有区块都记录在migratedBucket中
+func (bc *BlockChain) markBlocksMigrated(version int) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		migrated, err := tx.CreateBucketIfNotExists([]byte(migratedBucket))
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		err = tx.Bucket([]byte(blockChainBucket)).ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte(lastHashKey)) {
+				return nil
+			}
+			count++
+			return migrated.Put(k, []byte{byte(version)})
+		})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("marked %d blocks as migrated\n", count)
+		return putDBVersion(tx, version+1)
+	})
+}
+
+// 区块不变，只有UTXO集合和回滚数据的格式变了，直接删掉，之后按主链重建
+//  重建之后已有的挖矿交易output也要等CoinbaseMaturity个区块才能花费，原来能花的币可能暂时花不了
+func (bc *BlockChain) dropUTXOSet(version int) error {
+	log.Printf("coinbase outputs less than %d blocks deep become immature and can not be spent until they mature\n",
+		CoinbaseMaturity)
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{utxoBucket, undoBucket} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return putDBVersion(tx, version+1)
+	})
+}
+
+// 按父区块重新计算所有区块(包括侧链上的)的高度，创世块为0
+//  1. 加入高度之前的区块读出来Height都是0，新区块的高度和挖矿交易中的高度都对不上，主链就无法延长
+//  2. 区块hash不变，但pow和区块头已经无法按新的格式重新校验，改过的区块记录在migratedBucket中
+//  3. 高度索引、UTXO集合和回滚数据中都有高度，有区块改过时直接删掉，之后按主链重建
+//  版本1的区块金额还是float64，按legacyBlockV2读写
+func (bc *BlockChain) migrateHeights(version int) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(blockChainBucket))
+		migrated, err := tx.CreateBucketIfNotExists([]byte(migratedBucket))
+		if err != nil {
+			return err
+		}
+
+		blocks := make(map[string]*legacyBlockV2)
+		err = bucket.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte(lastHashKey)) {
+				return nil
+			}
+			var block legacyBlockV2
+			err := gobDecode(v, &block)
+			if err != nil {
+				return fmt.Errorf("decode block %x: %v", k, err)
+			}
+			blocks[string(k)] = &block
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// 高度是父区块的高度加1，算过的记下来，不用每次都走到创世块
+		heights := make(map[string]uint64)
+		var heightOf func(block *legacyBlockV2) (uint64, error)
+		heightOf = func(block *legacyBlockV2) (uint64, error) {
+			if height, ok := heights[string(block.Hash)]; ok {
+				return height, nil
+			}
+			var height uint64
+			if len(block.PrevHash) != 0 {
+				parent, ok := blocks[string(block.PrevHash)]
+				if !ok {
+					return 0, fmt.Errorf("block %x: parent %x not found", block.Hash, block.PrevHash)
+				}
+				parentHeight, err := heightOf(parent)
+				if err != nil {
+					return 0, err
+				}
+				height = parentHeight + 1
+			}
+			heights[string(block.Hash)] = height
+			return height, nil
+		}
+
+		count := 0
+		for hash, block := range blocks {
+			height, err := heightOf(block)
+			if err != nil {
+				return err
+			}
+			if block.Height == height {
+				continue
+			}
+			block.Height = height
+			err = bucket.Put([]byte(hash), gobEncode(block))
+			if err != nil {
+				return err
+			}
+			if migrated.Get([]byte(hash)) == nil {
+				err = migrated.Put([]byte(hash), []byte{byte(version)})
+				if err != nil {
+					return err
+				}
+			}
+			count++
+		}
+
+		if count > 0 {
+			for _, name := range []string{heightBucket, utxoBucket, undoBucket} {
+				err = tx.DeleteBucket([]byte(name))
+				if err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+		}
+
+		log.Printf("updated height of %d blocks\n", count)
+		return putDBVersion(tx, version+1)
+	})
+}
+
+// 把所有区块(包括侧链上的)从version版本的格式转换成下一个版本
+//  1. TxID和区块hash保持不变，高度索引和累计工作量都不受影响
+//  2. UTXO集合和回滚数据直接删掉，之后按主链重建
+//  3. 交易池中的交易是按旧格式签名的，无法转换，直接丢弃
+func (bc *BlockChain) migrateBlocks(version int, convert func(data []byte) ([]byte, error)) error {
+	return bc.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(blockChainBucket))
+		migrated, err := tx.CreateBucketIfNotExists([]byte(migratedBucket))
+		if err != nil {
+			return err
+		}
+
+		// ForEach的过程中不能修改bucket，先把所有区块转换好
+		converted := make(map[string][]byte)
+		err = bucket.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, []byte(lastHashKey)) {
+				return nil
+			}
+			data, err := convert(v)
+			if err != nil {
+				return fmt.Errorf("convert block %x: %v", k, err)
+			}
+			converted[string(k)] = data
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for hash, data := range converted {
+			err = bucket.Put([]byte(hash), data)
+			if err != nil {
+				return err
+			}
+			// 记录最早的版本
+			if migrated.Get([]byte(hash)) == nil {
+				err = migrated.Put([]byte(hash), []byte{byte(version)})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, name := range []string{utxoBucket, undoBucket, mempoolBucket} {
+			err = tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+
+		log.Printf("migrated %d blocks\n", len(converted))
+		return putDBVersion(tx, version+1)
+	})
+}
+
+// 版本3以前的input，签名和公钥直接存在input中
+type legacyTxInputV3 struct {
+	TxID      []byte
+	Index     int
+	Signature []byte
+	PubKey    []byte
+}
+
+// 版本2以前的交易和区块，除了金额是float64，其他字段和版本3一样
+//  gob按字段名解码，所以可以用这些结构直接读出旧的数据，没有Height字段的区块读出来是0
+type legacyTxOutputV2 struct {
+	Amount     float64
+	PubKeyHash []byte
+}
+
+type legacyTransactionV2 struct {
+	TxID      []byte
+	TxInputs  []*legacyTxInputV3
+	TxOutputs []*legacyTxOutputV2
+	Timestamp uint64
+}
+
+type legacyBlockV2 struct {
+	Version      uint64
+	PrevHash     []byte
+	MerkelRoot   []byte
+	TimeStamp    uint64
+	Difficulty   uint64
+	Nonce        uint64
+	Height       uint64
+	Hash         []byte
+	Transactions []*legacyTransactionV2
+}
+
+// 版本3的交易和区块，output中直接存收款方的公钥hash
+type legacyTxOutputV3 struct {
+	Amount     int64
+	PubKeyHash []byte
+}
+
+type legacyTransactionV3 struct {
+	TxID      []byte
+	TxInputs  []*legacyTxInputV3
+	TxOutputs []*legacyTxOutputV3
+	Timestamp uint64
+}
+
+type legacyBlockV3 struct {
+	Version      uint64
+	PrevHash     []byte
+	MerkelRoot   []byte
+	TimeStamp    uint64
+	Difficulty   uint64
+	Nonce        uint64
+	Height       uint64
+	Hash         []byte
+	Transactions []*legacyTransactionV3
+}
+
+// 把float64的BTC金额转换成聪，四舍五入到最近的整数
+func legacyAmount(amount float64) int64 {
+	return int64(math.Round(amount * SatoshiPerBitcoin))
+}
+
+// 版本2 -> 3：金额转换成聪
+func convertBlockV2(data []byte) ([]byte, error) {
+	var lb legacyBlockV2
+	err := gobDecode(data, &lb)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &legacyBlockV3{
+		Version:    lb.Version,
+		PrevHash:   lb.PrevHash,
+		MerkelRoot: lb.MerkelRoot,
+		TimeStamp:  lb.TimeStamp,
+		Difficulty: lb.Difficulty,
+		Nonce:      lb.Nonce,
+		Height:     lb.Height,
+		Hash:       lb.Hash,
+	}
+	for _, lt := range lb.Transactions {
+		t := &legacyTransactionV3{
+			TxID:      lt.TxID,
+			TxInputs:  lt.TxInputs,
+			Timestamp: lt.Timestamp,
+		}
+		for _, output := range lt.TxOutputs {
+			t.TxOutputs = append(t.TxOutputs, &legacyTxOutputV3{
+				Amount:     legacyAmount(output.Amount),
+				PubKeyHash: output.PubKeyHash,
+			})
+		}
+		block.Transactions = append(block.Transactions, t)
+	}
+	return gobEncode(block), nil
+}
+
+// 版本3 -> 4：公钥hash转换成P2PKH锁定脚本，签名和公钥转换成解锁脚本
+//  挖矿交易的PubKey是矿工填写的数据，直接作为解锁脚本
+func convertBlockV3(data []byte) ([]byte, error) {
+	var lb legacyBlockV3
+	err := gobDecode(data, &lb)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &Block{
+		Version:    lb.Version,
+		PrevHash:   lb.PrevHash,
+		MerkelRoot: lb.MerkelRoot,
+		TimeStamp:  lb.TimeStamp,
+		Difficulty: lb.Difficulty,
+		Nonce:      lb.Nonce,
+		Height:     lb.Height,
+		Hash:       lb.Hash,
+	}
+	for _, lt := range lb.Transactions {
+		t := &Transaction{
+			TxID:      lt.TxID,
+			Timestamp: lt.Timestamp,
+		}
+		for _, input := range lt.TxInputs {
+			scriptSig := input.PubKey
+			if input.Index != -1 {
+				scriptSig = NewP2PKHScriptSig(input.Signature, input.PubKey)
+			}
+			t.TxInputs = append(t.TxInputs, &TxInput{
+				TxID:      input.TxID,
+				Index:     input.Index,
+				ScriptSig: scriptSig,
+				Sequence:  SequenceFinal,
+			})
+		}
+		for _, output := range lt.TxOutputs {
+			t.TxOutputs = append(t.TxOutputs, &TxOutput{
+				Amount:       output.Amount,
+				ScriptPubKey: NewP2PKHScript(output.PubKeyHash),
+			})
+		}
+		block.Transactions = append(block.Transactions, t)
+	}
+	return block.Serialize(), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// testdata/blockchain_v0.db是改成二叉梅克尔树之前的版本创建的，创世块之后还有3个区块
+//  梅克尔根按新的算法对不上，也没有Height，读出来都是0，金额还是float64
+func TestMigrateLegacyChain(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/blockchain_v0.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(dir)
+	os.Chdir(t.TempDir())
+	err = ioutil.WriteFile(blockChainDB, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc := NewBlockChain("")
+	defer bc.db.Close()
+
+	if version := bc.getDBVersion(); version != dbVersion {
+		t.Fatalf("db version %d, want %d", version, dbVersion)
+	}
+	if height := bc.GetBestHeight(); height != 3 {
+		t.Fatalf("best height %d, want 3", height)
+	}
+	for height := uint64(0); height <= 3; height++ {
+		block, err := bc.GetBlockByHeight(height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Height != height {
+			t.Fatalf("block %x has height %d, want %d", block.Hash, block.Height, height)
+		}
+		// 当时的出块奖励是12.5个BTC
+		if amount := block.Transactions[0].TxOutputs[0].Amount; amount != 12.5*SatoshiPerBitcoin {
+			t.Fatalf("block %x coinbase pays %s, want 12.5", block.Hash, FormatAmount(amount))
+		}
+	}
+
+	// 迁移过的区块梅克尔根和pow按新的格式已经无法校验，只检查链接关系
+	count, err := bc.VerifyChain()
+	if err != nil || count != 4 {
+		t.Fatalf("VerifyChain() = %d, %v, want 4 blocks", count, err)
+	}
+
+	// 新区块的高度必须接在迁移后的高度后面
+	miner := NewWallet().NewAddress()
+	bc.AddBlock([]*Transaction{NewCoinBaseTx(miner, "", 4, 0)})
+	if height := bc.GetBestHeight(); height != 4 {
+		t.Fatalf("best height %d after mining, want 4", height)
+	}
+	count, err = bc.VerifyChain()
+	if err != nil || count != 5 {
+		t.Fatalf("VerifyChain() = %d, %v, want 5 blocks", count, err)
+	}
+}
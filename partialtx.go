@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// 部分签名的交易，用于多重签名和离线签名
+//  1. 联网的机器用createTx创建还没有签名的交易，连同input引用的交易一起保存到文件中
+//  2. 持有私钥的机器用signTx加上自己的签名，只需要钱包，不需要区块链数据，可以一直离线
+//     签名保存在PartialInput中，不直接写到解锁脚本里，多重签名时可以由多个人依次签名
+//  3. 签名够了之后在联网的机器上用broadcastTx组装成完整的交易，校验通过后放到交易池中
+type PartialTx struct {
+	Tx     *Transaction
+	Inputs []*PartialInput // 和Tx.TxInputs一一对应
+}
+
+type PartialInput struct {
+	// input引用的完整交易，它的hash必须等于input的TxID，参考setPrevOutputs
+	//  签名hash中没有金额，离线签名时只能用它确认引用的output金额没有被篡改，交易费才可信
+	PrevTx *Transaction
+	// PrevTx中input引用的output，离线签名时要用它的锁定脚本计算签名hash，用它的金额计算交易费
+	//  不保存到文件中，加载时从PrevTx中取出来
+	prevOutput *TxOutput
+	// input引用的P2SH output的赎回脚本，P2PKH的output为空
+	RedeemScript []byte
+	// 已经收集到的签名，map[hex(公钥)]签名
+	Signatures map[string][]byte
+}
+
+// 根据还没有签名的交易创建PartialTx，prevTxs是input引用的交易，map[hex(TxID)]交易
+//  input引用的output可以是P2PKH，也可以是P2SH，P2SH的赎回脚本必须在钱包中
+func NewPartialTx(tx *Transaction, ws *Wallets, prevTxs map[string]*Transaction) (*PartialTx, error) {
+	ptx := &PartialTx{Tx: tx}
+	for _, input := range tx.TxInputs {
+		ptx.Inputs = append(ptx.Inputs, &PartialInput{
+			PrevTx:     prevTxs[hex.EncodeToString(input.TxID)],
+			Signatures: make(map[string][]byte),
+		})
+	}
+	err := ptx.setPrevOutputs()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, pi := range ptx.Inputs {
+		prevOutput := pi.prevOutput
+		if scriptHash, ok := ExtractScriptHash(prevOutput.ScriptPubKey); ok {
+			address := ScriptHashToAddr(scriptHash)
+			pi.RedeemScript = ws.RedeemScripts[address]
+			if pi.RedeemScript == nil {
+				return nil, fmt.Errorf("redeem script of %s not found in wallet", address)
+			}
+		} else if _, ok := ExtractPubKeyHash(prevOutput.ScriptPubKey); !ok {
+			return nil, fmt.Errorf("input %d: unsupported locking script %s", i, DisasmScript(prevOutput.ScriptPubKey))
+		}
+	}
+	return ptx, nil
+}
+
+// 从input引用的完整交易中取出引用的output
+//  交易重新计算的hash必须等于input的TxID，文件中的金额或锁定脚本被改过时hash就对不上了
+//  从旧版本迁移过来的交易hash已经无法重新计算，不能用来离线签名
+func (ptx *PartialTx) setPrevOutputs() error {
+	for i, input := range ptx.Tx.TxInputs {
+		pi := ptx.Inputs[i]
+		if pi.PrevTx == nil {
+			return fmt.Errorf("input %d: previous tx %x not found", i, input.TxID)
+		}
+		if !bytes.Equal(pi.PrevTx.TxID, input.TxID) || !bytes.Equal(pi.PrevTx.CalcHash(), input.TxID) {
+			return fmt.Errorf("input %d: previous tx does not match txid %x", i, input.TxID)
+		}
+		if input.Index < 0 || input.Index >= len(pi.PrevTx.TxOutputs) {
+			return fmt.Errorf("input %d references invalid output", i)
+		}
+		pi.prevOutput = pi.PrevTx.TxOutputs[input.Index]
+	}
+	return nil
+}
+
+// 所有input引用的output，map["TxID:index"]output，和UTXOSet.FindPrevOutputs的返回值格式一样
+func (ptx *PartialTx) PrevOutputs() map[string]*TxOutput {
+	prevOutputs := make(map[string]*TxOutput)
+	for i, input := range ptx.Tx.TxInputs {
+		prevOutputs[outpointKey(input.TxID, input.Index)] = ptx.Inputs[i].prevOutput
+	}
+	return prevOutputs
+}
+
+// input需要哪些公钥签名，以及需要几个签名
+//  P2PKH只有一个公钥，但文件中只有公钥hash，所以返回公钥hash，签名时再从钱包中找到对应的公钥
+func (pi *PartialInput) signers() (m int, pubKeys [][]byte, pubKeyHash []byte, err error) {
+	if pi.RedeemScript == nil {
+		pubKeyHash, ok := ExtractPubKeyHash(pi.prevOutput.ScriptPubKey)
+		if !ok {
+			return 0, nil, nil, errors.New("locking script is not P2PKH")
+		}
+		return 1, nil, pubKeyHash, nil
+	}
+	m, pubKeys, ok := ParseMultiSigScript(pi.RedeemScript)
+	if !ok {
+		return 0, nil, nil, errors.New("redeem script is not multisig")
+	}
+	return m, pubKeys, nil, nil
+}
+
+// 用钱包中的私钥给所有能签的input签名，已经签过的不重复签
+//  @return int 新增加的签名数量
+func (ptx *PartialTx) Sign(ws *Wallets) (int, error) {
+	if !bytes.Equal(ptx.Tx.CalcHash(), ptx.Tx.TxID) {
+		return 0, fmt.Errorf("tx %x has invalid txid", ptx.Tx.TxID)
+	}
+	if err := ws.CheckUnlocked(); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i, pi := range ptx.Inputs {
+		_, pubKeys, pubKeyHash, err := pi.signers()
+		if err != nil {
+			return count, fmt.Errorf("input %d: %v", i, err)
+		}
+
+		// P2PKH签的是output的锁定脚本，P2SH签的是赎回脚本
+		prevScript := pi.RedeemScript
+		if pubKeyHash != nil {
+			prevScript = pi.prevOutput.ScriptPubKey
+			if wallet := ws.WalletsMap[PubKeyHashToAddr(pubKeyHash)]; wallet != nil {
+				pubKeys = [][]byte{wallet.PubKey}
+			}
+		}
+
+		hash := ptx.Tx.SignatureHash(i, prevScript)
+		for _, pubKey := range pubKeys {
+			key := hex.EncodeToString(pubKey)
+			if _, ok := pi.Signatures[key]; ok {
+				continue
+			}
+			wallet := ws.WalletByPubKey(pubKey)
+			if wallet == nil {
+				continue
+			}
+			pi.Signatures[key] = SignHash(wallet.Private, hash)
+			count++
+		}
+	}
+	return count, nil
+}
+
+// 每个input已经收集到的签名数量和需要的签名数量
+func (ptx *PartialTx) SignatureCount(i int) (int, int) {
+	pi := ptx.Inputs[i]
+	m, pubKeys, _, err := pi.signers()
+	if err != nil {
+		return 0, 0
+	}
+	if pubKeys == nil {
+		return len(pi.Signatures), m
+	}
+	have := 0
+	for _, pubKey := range pubKeys {
+		if _, ok := pi.Signatures[hex.EncodeToString(pubKey)]; ok {
+			have++
+		}
+	}
+	return have, m
+}
+
+// 签名够了之后组装解锁脚本，并用文件中的output校验一遍
+//  P2PKH：<签名> <公钥>
+//  P2SH：OP_0 <签名1> ... <签名m> <赎回脚本>，签名必须和赎回脚本中公钥的顺序一致，多出来的签名不需要
+func (ptx *PartialTx) Finalize() (*Transaction, error) {
+	for i, pi := range ptx.Inputs {
+		m, pubKeys, _, err := pi.signers()
+		if err != nil {
+			return nil, fmt.Errorf("input %d: %v", i, err)
+		}
+
+		if pubKeys == nil {
+			if len(pi.Signatures) == 0 {
+				return nil, fmt.Errorf("input %d has 0 of 1 signatures", i)
+			}
+			for key, signature := range pi.Signatures {
+				pubKey, _ := hex.DecodeString(key)
+				ptx.Tx.TxInputs[i].ScriptSig = NewP2PKHScriptSig(signature, pubKey)
+			}
+			continue
+		}
+
+		// OP_CHECKMULTISIG会多弹出一个元素，所以最前面要多放一个OP_0
+		scriptSig := []byte{OP_0}
+		have := 0
+		for _, pubKey := range pubKeys {
+			signature, ok := pi.Signatures[hex.EncodeToString(pubKey)]
+			if !ok {
+				continue
+			}
+			scriptSig = append(scriptSig, pushData(signature)...)
+			have++
+			if have == m {
+				break
+			}
+		}
+		if have < m {
+			return nil, fmt.Errorf("input %d has %d of %d signatures", i, have, m)
+		}
+
+		ptx.Tx.TxInputs[i].ScriptSig = append(scriptSig, pushData(pi.RedeemScript)...)
+	}
+
+	if !ptx.Tx.Verify(ptx.PrevOutputs()) {
+		return nil, fmt.Errorf("tx %x verify failed", ptx.Tx.TxID)
+	}
+	return ptx.Tx, nil
+}
+
+// 保存到文件中，发给其他人签名
+func (ptx *PartialTx) SaveToFile(file string) error {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(ptx)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, buffer.Bytes(), 0644)
+}
+
+func LoadPartialTx(file string) (*PartialTx, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ptx PartialTx
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&ptx)
+	if err != nil {
+		return nil, err
+	}
+	if ptx.Tx == nil || len(ptx.Inputs) != len(ptx.Tx.TxInputs) {
+		return nil, fmt.Errorf("%s is not a valid partially signed tx", file)
+	}
+	// gob不会保存空的map
+	for _, pi := range ptx.Inputs {
+		if pi.Signatures == nil {
+			pi.Signatures = make(map[string][]byte)
+		}
+	}
+	err = ptx.setPrevOutputs()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return &ptx, nil
+}
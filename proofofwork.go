@@ -3,10 +3,23 @@ package main
 import (
 	"bytes"
 	"crypto/sha256"
+	"errors"
+	"fmt"
 	"log"
 	"math/big"
 )
 
+const (
+	// 初始难度，紧凑格式(compact bits)，对应target 0x0000100000...
+	InitialBits uint64 = 0x1e100000
+	// 难度下限(即target上限)，再简单也不能超过这个值
+	PowLimitBits uint64 = 0x1f00ffff
+	// 每隔多少个区块调整一次难度
+	RetargetInterval = 10
+	// 期望的出块间隔，单位秒
+	TargetBlockSpacing = 10
+)
+
 // 1. 定义pow结构
 type ProofOfWork struct {
 	block *Block
@@ -16,19 +29,31 @@ type ProofOfWork struct {
 
 // 2. 提供创建POW的函数
 func NewProofOfWork(block *Block) *ProofOfWork {
+	// 难度值不再写死，而是从区块头的Difficulty(紧凑格式)还原出target
 	pow := &ProofOfWork{
 		block:  block,
-		target: big.NewInt(1),
+		target: CompactToBig(block.Difficulty),
 	}
-
-	// 我们指定的难度值，现在是一个string类型，需要转换
-	targetStr := "0000100000000000000000000000000000000000000000000000000000000000"
-	//targetStr := "4f0f23fd637149e0db995b17c8ca26d1209119480f5d466f239d9676262753f8"
-	tmpInt, _ := new(big.Int).SetString(targetStr, 16)
-	pow.target = tmpInt
 	return pow
 }
 
+// 拼装区块头数据(区块数据，还有不断变化的随机数)
+func (pow *ProofOfWork) prepareData(nonce uint64) []byte {
+	b := pow.block
+	tmp := [][]byte{
+		Uint64ToByte(b.Version),
+		b.PrevHash,
+		b.MerkelRoot,
+		Uint64ToByte(b.TimeStamp),
+		Uint64ToByte(b.Difficulty),
+		Uint64ToByte(nonce),
+		Uint64ToByte(b.Height),
+		// 只对区块头做hash，区块体通过MerkelRoot产生影响
+		//b.Data,
+	}
+	return bytes.Join(tmp, []byte{})
+}
+
 // 3. 提供不断计算hash的函数
 func (pow *ProofOfWork) Run() (hash []byte, nonce uint64) {
 	// 拼装数据(区块数据，还有不断变化的随机数)
@@ -38,23 +63,18 @@ func (pow *ProofOfWork) Run() (hash []byte, nonce uint64) {
 	var calcHash [32]byte
 	b := pow.block
 
+	// 符号位被置上的难度值target不是正数，永远找不到满足条件的hash
+	if err := pow.checkTarget(); err != nil {
+		log.Panic(err)
+	}
+
 	for {
-		tmp := [][]byte{
-			Uint64ToByte(b.Version),
-			b.PrevHash,
-			b.MerkelRoot,
-			Uint64ToByte(b.TimeStamp),
-			Uint64ToByte(b.Difficulty),
-			Uint64ToByte(nonce),
-			// 只对区块头做hash，区块体通过MerkelRoot产生影响
-			//b.Data,
-		}
-		blockInfo := bytes.Join(tmp, []byte{})
+		blockInfo := pow.prepareData(nonce)
 
 		calcHash = sha256.Sum256(blockInfo)
 		tmpInt := new(big.Int).SetBytes(calcHash[:])
 		if tmpInt.Cmp(pow.target) == -1 {
-			address := PubKeyHashToAddr(b.Transactions[0].TxOutputs[0].PubKeyHash)
+			address, _ := b.Transactions[0].TxOutputs[0].Address()
 			log.Printf("miner %s found block, hash: %x, nonce: %d", address, calcHash, nonce)
 			hash = calcHash[:]
 			break
@@ -66,3 +86,130 @@ func (pow *ProofOfWork) Run() (hash []byte, nonce uint64) {
 }
 
 // 4. 提供一个校验函数
+//  用于校验从数据库读出来或者从其他节点收到的区块
+//  1. 难度值必须合法，不能比PowLimitBits还简单
+//  2. 用区块中的Nonce重新计算区块头hash，必须小于Difficulty对应的target
+//  3. 重新计算的hash必须和区块中记录的Hash一致
+//  4. 根据交易重新计算梅克尔根，必须和区块头中的MerkelRoot一致
+func (pow *ProofOfWork) Validate() error {
+	b := pow.block
+
+	if err := pow.checkTarget(); err != nil {
+		return err
+	}
+
+	calcHash := sha256.Sum256(pow.prepareData(b.Nonce))
+	tmpInt := new(big.Int).SetBytes(calcHash[:])
+	if tmpInt.Cmp(pow.target) != -1 {
+		return fmt.Errorf("hash %x does not meet target of difficulty %08x", calcHash, b.Difficulty)
+	}
+
+	if !bytes.Equal(calcHash[:], b.Hash) {
+		return fmt.Errorf("block hash mismatch, stored: %x, calculated: %x", b.Hash, calcHash)
+	}
+
+	if len(b.Transactions) == 0 {
+		return errors.New("block has no transactions")
+	}
+	if !bytes.Equal(b.MakeMerkelRoot(), b.MerkelRoot) {
+		return fmt.Errorf("merkel root mismatch, stored: %x, calculated: %x", b.MerkelRoot, b.MakeMerkelRoot())
+	}
+
+	return nil
+}
+
+// 难度值对应的target必须是正数，并且不能超过PowLimitBits对应的target
+func (pow *ProofOfWork) checkTarget() error {
+	if pow.target.Sign() <= 0 || pow.target.Cmp(CompactToBig(PowLimitBits)) > 0 {
+		return fmt.Errorf("invalid difficulty %08x", pow.block.Difficulty)
+	}
+	return nil
+}
+
+// 将紧凑格式的难度值转换成target
+//  紧凑格式与比特币nBits一致：最高字节为target的字节长度(指数)，低3字节为尾数
+//  target = 尾数 * 256^(指数-3)
+func CompactToBig(bits uint64) *big.Int {
+	mantissa := bits & 0x007fffff
+	isNegative := bits&0x00800000 != 0
+	exponent := uint(bits >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = new(big.Int).SetUint64(mantissa)
+	} else {
+		target = new(big.Int).SetUint64(mantissa)
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	if isNegative {
+		target = target.Neg(target)
+	}
+	return target
+}
+
+// 将target转换成紧凑格式的难度值，是CompactToBig的逆运算
+func BigToCompact(target *big.Int) uint64 {
+	if target.Sign() == 0 {
+		return 0
+	}
+
+	var mantissa uint64
+	exponent := uint(len(target.Bytes()))
+	if exponent <= 3 {
+		mantissa = target.Uint64()
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tmp := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = tmp.Uint64()
+	}
+
+	// 尾数的最高位是符号位，如果被占用了，就把尾数右移一个字节，指数加1
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	bits := uint64(exponent)<<24 | mantissa
+	if target.Sign() < 0 {
+		bits |= 0x00800000
+	}
+	return bits
+}
+
+// 计算一个区块的工作量，即找到这个难度的hash平均需要计算的次数 2^256 / (target+1)
+func BlockWork(bits uint64) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// 根据实际出块时间重新计算难度
+//  @param bits 上一个调整周期的难度
+//  @param actualTimespan 这个周期内实际花费的时间，单位秒
+//  @param targetTimespan 这个周期内期望花费的时间，单位秒
+func RetargetDifficulty(bits uint64, actualTimespan, targetTimespan int64) uint64 {
+	// 限制单次调整的幅度，最多4倍
+	if actualTimespan < targetTimespan/4 {
+		actualTimespan = targetTimespan / 4
+	} else if actualTimespan > targetTimespan*4 {
+		actualTimespan = targetTimespan * 4
+	}
+
+	// 新target = 旧target * 实际时间 / 期望时间，出块越慢target越大，难度越低
+	newTarget := CompactToBig(bits)
+	newTarget.Mul(newTarget, big.NewInt(actualTimespan))
+	newTarget.Div(newTarget, big.NewInt(targetTimespan))
+
+	// 旧的难度值不合法(target不是正数)时，新的也不合法，直接用最低难度
+	powLimit := CompactToBig(PowLimitBits)
+	if newTarget.Sign() <= 0 || newTarget.Cmp(powLimit) > 0 {
+		newTarget = powLimit
+	}
+
+	return BigToCompact(newTarget)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+)
+
+// 置上符号位的难度值对应负数target，Run永远找不到hash，必须当成不合法的难度值
+func TestNegativeTargetIsInvalid(t *testing.T) {
+	bits := PowLimitBits | 0x00800000
+	if CompactToBig(bits).Sign() >= 0 {
+		t.Fatalf("CompactToBig(%08x) is not negative", bits)
+	}
+
+	if err := NewProofOfWork(&Block{Difficulty: bits}).Validate(); err == nil {
+		t.Fatal("Validate() accepted a negative target")
+	}
+	if got := RetargetDifficulty(bits, 1, 1); got != PowLimitBits {
+		t.Fatalf("RetargetDifficulty(%08x) = %08x, want %08x", bits, got, PowLimitBits)
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 一个简化版的BTC脚本引擎
+//  output中保存锁定脚本ScriptPubKey，input中保存解锁脚本ScriptSig
+//  校验时先执行解锁脚本，再在同一个栈上执行锁定脚本，最后栈顶为true才算解锁成功
+//  P2PKH:
+//    ScriptPubKey: OP_DUP OP_HASH160 <公钥hash> OP_EQUALVERIFY OP_CHECKSIG
+//    ScriptSig:    <签名> <公钥>
+//  P2SH(锁定在一个赎回脚本的hash上，比如多重签名):
+//    ScriptPubKey: OP_HASH160 <赎回脚本hash> OP_EQUAL
+//    ScriptSig:    <赎回脚本需要的数据> ... <赎回脚本>
+
+const (
+	OP_0         = 0x00 // 压入一个空数据，表示false
+	OP_PUSHDATA1 = 0x4c // 后面1个字节是数据长度
+	OP_PUSHDATA2 = 0x4d // 后面2个字节(小端)是数据长度
+	OP_1         = 0x51 // OP_1到OP_16压入数字1到16
+	OP_16        = 0x60
+
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+	OP_DROP   = 0x75
+	OP_DUP    = 0x76
+
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+
+	OP_HASH160       = 0xa9
+	OP_CHECKSIG      = 0xac
+	OP_CHECKMULTISIG = 0xae
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+)
+
+const (
+	maxScriptSize       = 10000
+	maxStackSize        = 1000
+	maxPubKeysPerMulti  = 20
+	maxPubKeysPerP2SH   = 15 // 赎回脚本中m和n只能用OP_1到OP_16表示，15个压缩公钥刚好不超过maxScriptPushLength
+	maxScriptNumLength  = 4
+	lockTimeNumLength   = 5 // 时间锁的数字可能超过4个字节
+	maxScriptPushLength = 520
+)
+
+var opcodeNames = map[byte]string{
+	OP_0:                   "OP_0",
+	OP_PUSHDATA1:           "OP_PUSHDATA1",
+	OP_PUSHDATA2:           "OP_PUSHDATA2",
+	OP_VERIFY:              "OP_VERIFY",
+	OP_RETURN:              "OP_RETURN",
+	OP_DROP:                "OP_DROP",
+	OP_DUP:                 "OP_DUP",
+	OP_EQUAL:               "OP_EQUAL",
+	OP_EQUALVERIFY:         "OP_EQUALVERIFY",
+	OP_HASH160:             "OP_HASH160",
+	OP_CHECKSIG:            "OP_CHECKSIG",
+	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// 脚本中的一条指令，压入数据的指令data不为nil
+type scriptOp struct {
+	opcode byte
+	data   []byte
+}
+
+func (op *scriptOp) isPush() bool {
+	return op.opcode <= OP_PUSHDATA2
+}
+
+// 把脚本解析成指令列表
+func parseScript(script []byte) ([]scriptOp, error) {
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("script size %d exceeds %d", len(script), maxScriptSize)
+	}
+
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		opcode := script[i]
+		i++
+
+		var length int
+		switch {
+		case opcode == OP_0:
+			ops = append(ops, scriptOp{opcode: opcode, data: []byte{}})
+			continue
+		case opcode < OP_PUSHDATA1:
+			length = int(opcode)
+		case opcode == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("script truncated at OP_PUSHDATA1")
+			}
+			length = int(script[i])
+			i++
+		case opcode == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("script truncated at OP_PUSHDATA2")
+			}
+			length = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		default:
+			ops = append(ops, scriptOp{opcode: opcode})
+			continue
+		}
+
+		if i+length > len(script) {
+			return nil, fmt.Errorf("script truncated, push %d bytes but %d left", length, len(script)-i)
+		}
+		ops = append(ops, scriptOp{opcode: opcode, data: script[i : i+length]})
+		i += length
+	}
+	return ops, nil
+}
+
+// 生成压入数据的指令，按数据长度选择最短的写法
+func pushData(data []byte) []byte {
+	var script []byte
+	switch {
+	case len(data) == 0:
+		return []byte{OP_0}
+	case len(data) == 1 && data[0] >= 1 && data[0] <= 16:
+		return []byte{OP_1 - 1 + data[0]}
+	case len(data) < OP_PUSHDATA1:
+		script = []byte{byte(len(data))}
+	case len(data) <= 0xff:
+		script = []byte{OP_PUSHDATA1, byte(len(data))}
+	default:
+		script = []byte{OP_PUSHDATA2, byte(len(data)), byte(len(data) >> 8)}
+	}
+	return append(script, data...)
+}
+
+// 生成压入数字的指令
+func pushInt(n int64) []byte {
+	if n >= 1 && n <= 16 {
+		return []byte{byte(OP_1 - 1 + n)}
+	}
+	return pushData(encodeScriptNum(n))
+}
+
+// 脚本中的数字是小端的变长整数，最高字节的最高位是符号位，0编码成空数据
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+
+	negative := n < 0
+	abs := uint64(n)
+	if negative {
+		abs = uint64(-n)
+	}
+
+	var result []byte
+	for abs > 0 {
+		result = append(result, byte(abs&0xff))
+		abs >>= 8
+	}
+	// 最高位已经被占用时，需要多加一个字节存放符号位
+	if result[len(result)-1]&0x80 != 0 {
+		if negative {
+			result = append(result, 0x80)
+		} else {
+			result = append(result, 0x00)
+		}
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+func decodeScriptNum(data []byte, maxLength int) (int64, error) {
+	if len(data) > maxLength {
+		return 0, fmt.Errorf("script number %x is longer than %d bytes", data, maxLength)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8*i)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		n &= ^(int64(0x80) << uint(8*(len(data)-1)))
+		n = -n
+	}
+	return n, nil
+}
+
+// 栈上的数据转成bool，全0(包括负0)为false
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			// 负0
+			if i == len(data)-1 && b == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// P2PKH锁定脚本：OP_DUP OP_HASH160 <公钥hash> OP_EQUALVERIFY OP_CHECKSIG
+func NewP2PKHScript(pubKeyHash []byte) []byte {
+	script := []byte{OP_DUP, OP_HASH160}
+	script = append(script, pushData(pubKeyHash)...)
+	return append(script, OP_EQUALVERIFY, OP_CHECKSIG)
+}
+
+// P2PKH解锁脚本：<签名> <公钥>
+func NewP2PKHScriptSig(signature, pubKey []byte) []byte {
+	return append(pushData(signature), pushData(pubKey)...)
+}
+
+// 多重签名锁定脚本：m <公钥1> ... <公钥n> n OP_CHECKMULTISIG，需要n个公钥中任意m个的签名才能解锁
+//  脚本作为赎回脚本放在解锁脚本中压栈，长度不能超过maxScriptPushLength，否则永远无法花费
+func NewMultiSigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > maxPubKeysPerP2SH {
+		return nil, fmt.Errorf("multisig needs 1 to %d pubkeys, got %d", maxPubKeysPerP2SH, n)
+	}
+	if m <= 0 || m > n {
+		return nil, fmt.Errorf("multisig needs 1 to %d signatures, got %d", n, m)
+	}
+
+	script := pushInt(int64(m))
+	for _, pubKey := range pubKeys {
+		if _, err := parsePubKeyOnAnyCurve(pubKey); err != nil {
+			return nil, fmt.Errorf("pubkey %x is invalid: %v", pubKey, err)
+		}
+		script = append(script, pushData(pubKey)...)
+	}
+	script = append(script, pushInt(int64(n))...)
+	script = append(script, OP_CHECKMULTISIG)
+	if len(script) > maxScriptPushLength {
+		return nil, fmt.Errorf("multisig script is %d bytes, exceeds %d", len(script), maxScriptPushLength)
+	}
+	return script, nil
+}
+
+// 解析多重签名脚本，返回需要的签名数量和所有公钥
+func ParseMultiSigScript(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].opcode != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+
+	m, ok := smallInt(ops[0].opcode)
+	if !ok {
+		return 0, nil, false
+	}
+	n, ok := smallInt(ops[len(ops)-2].opcode)
+	if !ok || n != len(ops)-3 || m > n {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if !op.isPush() || len(op.data) == 0 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, true
+}
+
+// OP_1到OP_16对应的数字
+func smallInt(opcode byte) (int, bool) {
+	if opcode >= OP_1 && opcode <= OP_16 {
+		return int(opcode - OP_1 + 1), true
+	}
+	return 0, false
+}
+
+// P2SH锁定脚本：OP_HASH160 <赎回脚本hash> OP_EQUAL
+func NewP2SHScript(scriptHash []byte) []byte {
+	script := []byte{OP_HASH160}
+	script = append(script, pushData(scriptHash)...)
+	return append(script, OP_EQUAL)
+}
+
+// 如果是P2SH锁定脚本，返回其中的赎回脚本hash
+func ExtractScriptHash(script []byte) ([]byte, bool) {
+	if len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL {
+		return script[2:22], true
+	}
+	return nil, false
+}
+
+// OP_RETURN <数据>，用于在链上存储数据，这样的output永远不能被花费
+func NewNullDataScript(data []byte) []byte {
+	return append([]byte{OP_RETURN}, pushData(data)...)
+}
+
+// 如果是P2PKH锁定脚本，返回其中的公钥hash
+func ExtractPubKeyHash(script []byte) ([]byte, bool) {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23], true
+	}
+	return nil, false
+}
+
+// 以OP_RETURN开头的脚本永远无法解锁，不需要放进UTXO集合
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN
+}
+
+// 把脚本转成可读的形式，压入的数据用16进制显示
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[error: %v] %x", err, script)
+	}
+
+	var words []string
+	for _, op := range ops {
+		switch {
+		case op.opcode == OP_0:
+			words = append(words, "OP_0")
+		case op.isPush():
+			words = append(words, hex.EncodeToString(op.data))
+		default:
+			words = append(words, opcodeName(op.opcode))
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func opcodeName(opcode byte) string {
+	if name, ok := opcodeNames[opcode]; ok {
+		return name
+	}
+	if opcode >= OP_1 && opcode <= OP_16 {
+		return fmt.Sprintf("OP_%d", opcode-OP_1+1)
+	}
+	if opcode < OP_PUSHDATA1 {
+		return fmt.Sprintf("OP_PUSHBYTES_%d", opcode)
+	}
+	return fmt.Sprintf("OP_UNKNOWN_%02x", opcode)
+}
+
+// 执行脚本时需要的交易信息，OP_CHECKSIG和时间锁都要用到
+type scriptContext struct {
+	tx    *Transaction
+	index int // 正在校验的input
+	// input引用的output的锁定脚本，参与签名数据的计算
+	prevScript []byte
+}
+
+type scriptEngine struct {
+	stack [][]byte
+	ctx   *scriptContext
+}
+
+func (e *scriptEngine) push(data []byte) error {
+	if len(e.stack) >= maxStackSize {
+		return errors.New("stack overflow")
+	}
+	e.stack = append(e.stack, data)
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	data := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return data, nil
+}
+
+func (e *scriptEngine) peek() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errors.New("stack underflow")
+	}
+	return e.stack[len(e.stack)-1], nil
+}
+
+func (e *scriptEngine) popInt(maxLength int) (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data, maxLength)
+}
+
+func (e *scriptEngine) execute(script []byte) error {
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range ops {
+		err = e.step(&op)
+		if err != nil {
+			return fmt.Errorf("%s: %v", opcodeName(op.opcode), err)
+		}
+	}
+	return nil
+}
+
+// 执行一条指令
+func (e *scriptEngine) step(op *scriptOp) error {
+	if op.isPush() {
+		if len(op.data) > maxScriptPushLength {
+			return fmt.Errorf("push %d bytes exceeds %d", len(op.data), maxScriptPushLength)
+		}
+		return e.push(op.data)
+	}
+	if op.opcode >= OP_1 && op.opcode <= OP_16 {
+		return e.push(encodeScriptNum(int64(op.opcode - OP_1 + 1)))
+	}
+
+	switch op.opcode {
+	case OP_VERIFY:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		if !castToBool(data) {
+			return errors.New("verify failed")
+		}
+
+	case OP_RETURN:
+		return errors.New("script is unspendable")
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+
+	case OP_DUP:
+		data, err := e.peek()
+		if err != nil {
+			return err
+		}
+		return e.push(data)
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		equal := bytes.Equal(a, b)
+		if op.opcode == OP_EQUALVERIFY {
+			if !equal {
+				return errors.New("not equal")
+			}
+			return nil
+		}
+		return e.push(boolToScript(equal))
+
+	case OP_HASH160:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(HashPubKey(data))
+
+	case OP_CHECKSIG:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.push(boolToScript(e.checkSig(signature, pubKey)))
+
+	case OP_CHECKMULTISIG:
+		return e.checkMultiSig()
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+
+	case OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequence()
+
+	default:
+		return errors.New("unknown opcode")
+	}
+	return nil
+}
+
+func boolToScript(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+func (e *scriptEngine) checkSig(signature, pubKey []byte) bool {
+	if len(signature) == 0 || len(pubKey) == 0 {
+		return false
+	}
+	hash := e.ctx.tx.SignatureHash(e.ctx.index, e.ctx.prevScript)
+	return verifySignature(pubKey, hash, signature)
+}
+
+// 栈上从上到下依次是：n <公钥n> ... <公钥1> m <签名m> ... <签名1> <dummy>
+//  签名必须和公钥的顺序一致，每个签名只能往后匹配公钥
+//  和BTC一样会多弹出一个dummy元素，这个元素必须为空
+func (e *scriptEngine) checkMultiSig() error {
+	n, err := e.popInt(maxScriptNumLength)
+	if err != nil {
+		return err
+	}
+	if n < 0 || n > maxPubKeysPerMulti {
+		return fmt.Errorf("invalid pubkey count %d", n)
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		pubKeys[i], err = e.pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	m, err := e.popInt(maxScriptNumLength)
+	if err != nil {
+		return err
+	}
+	if m < 0 || m > n {
+		return fmt.Errorf("invalid signature count %d", m)
+	}
+	signatures := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		signatures[i], err = e.pop()
+		if err != nil {
+			return err
+		}
+	}
+
+	dummy, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if len(dummy) != 0 {
+		return errors.New("multisig dummy element must be empty")
+	}
+
+	success := true
+	keyIndex := 0
+	for _, signature := range signatures {
+		matched := false
+		for keyIndex < len(pubKeys) {
+			pubKey := pubKeys[keyIndex]
+			keyIndex++
+			if e.checkSig(signature, pubKey) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			success = false
+			break
+		}
+	}
+	return e.push(boolToScript(success))
+}
+
+// 绝对时间锁：栈顶的值不能大于交易的LockTime，两者必须同为高度或者同为时间戳
+//  和OP_DROP配合使用：<锁定时间> OP_CHECKLOCKTIMEVERIFY OP_DROP ...
+func (e *scriptEngine) checkLockTime() error {
+	data, err := e.peek()
+	if err != nil {
+		return err
+	}
+	lockTime, err := decodeScriptNum(data, lockTimeNumLength)
+	if err != nil {
+		return err
+	}
+	if lockTime < 0 {
+		return fmt.Errorf("negative lock time %d", lockTime)
+	}
+
+	tx := e.ctx.tx
+	if (lockTime < LockTimeThreshold) != (tx.LockTime < LockTimeThreshold) {
+		return fmt.Errorf("lock time type mismatch, script %d, tx %d", lockTime, tx.LockTime)
+	}
+	if uint64(lockTime) > tx.LockTime {
+		return fmt.Errorf("locked until %d, tx lock time is %d", lockTime, tx.LockTime)
+	}
+	// Sequence为最终值时交易的LockTime不生效，时间锁也就失去了意义
+	if tx.TxInputs[e.ctx.index].Sequence == SequenceFinal {
+		return errors.New("input sequence is final")
+	}
+	return nil
+}
+
+// 相对时间锁：input引用的output上链之后，至少要再经过栈顶指定的区块数才能花费
+//  只比较input的Sequence，真正的区块数由共识规则检查，参考sequenceLocksInBucket
+//  和OP_DROP配合使用：<区块数> OP_CHECKSEQUENCEVERIFY OP_DROP ...
+func (e *scriptEngine) checkSequence() error {
+	data, err := e.peek()
+	if err != nil {
+		return err
+	}
+	sequence, err := decodeScriptNum(data, lockTimeNumLength)
+	if err != nil {
+		return err
+	}
+	if sequence < 0 {
+		return fmt.Errorf("negative sequence %d", sequence)
+	}
+	// 脚本中的值设置了禁用标志时，相当于什么都不做
+	if uint32(sequence)&SequenceLockDisableFlag != 0 {
+		return nil
+	}
+
+	txSequence := e.ctx.tx.TxInputs[e.ctx.index].Sequence
+	if txSequence&SequenceLockDisableFlag != 0 {
+		return errors.New("relative lock of input is disabled")
+	}
+	if uint32(sequence)&SequenceLockMask > txSequence&SequenceLockMask {
+		return fmt.Errorf("locked for %d blocks, input sequence is %d",
+			uint32(sequence)&SequenceLockMask, txSequence&SequenceLockMask)
+	}
+	return nil
+}
+
+// 用input的解锁脚本解锁output的锁定脚本
+//  1. 解锁脚本只能包含压入数据的指令
+//  2. 先执行解锁脚本，栈保留下来再执行锁定脚本
+//  3. 最后栈顶的值为true时解锁成功
+//  4. 锁定脚本是P2SH时，解锁脚本最后压入的数据是赎回脚本，
+//     还要用解锁脚本剩下的数据执行一遍赎回脚本，签名的数据也是按赎回脚本计算的
+func VerifyScript(scriptSig, scriptPubKey []byte, tx *Transaction, index int) error {
+	ops, err := parseScript(scriptSig)
+	if err != nil {
+		return fmt.Errorf("scriptSig: %v", err)
+	}
+	for _, op := range ops {
+		if !op.isPush() && (op.opcode < OP_1 || op.opcode > OP_16) {
+			return errors.New("scriptSig is not push only")
+		}
+	}
+
+	engine := &scriptEngine{
+		ctx: &scriptContext{
+			tx:         tx,
+			index:      index,
+			prevScript: scriptPubKey,
+		},
+	}
+	err = engine.execute(scriptSig)
+	if err != nil {
+		return fmt.Errorf("scriptSig: %v", err)
+	}
+	stackCopy := append([][]byte{}, engine.stack...)
+
+	err = engine.execute(scriptPubKey)
+	if err != nil {
+		return fmt.Errorf("scriptPubKey: %v", err)
+	}
+	top, err := engine.peek()
+	if err != nil || !castToBool(top) {
+		return errors.New("script evaluated to false")
+	}
+
+	if _, ok := ExtractScriptHash(scriptPubKey); !ok {
+		return nil
+	}
+
+	// P2SH，锁定脚本已经校验了赎回脚本的hash，接着执行赎回脚本
+	if len(stackCopy) == 0 {
+		return errors.New("p2sh: missing redeem script")
+	}
+	redeemScript := stackCopy[len(stackCopy)-1]
+	engine.stack = stackCopy[:len(stackCopy)-1]
+	engine.ctx.prevScript = redeemScript
+	err = engine.execute(redeemScript)
+	if err != nil {
+		return fmt.Errorf("redeemScript: %v", err)
+	}
+	top, err = engine.peek()
+	if err != nil || !castToBool(top) {
+		return errors.New("redeem script evaluated to false")
+	}
+	return nil
+}
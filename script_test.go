@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+)
+
+// 赎回脚本压栈时不能超过maxScriptPushLength，公钥太多时要在创建地址时就报错
+func TestMultiSigScriptTooLarge(t *testing.T) {
+	var compressed, uncompressed [][]byte
+	for i := 0; i < maxPubKeysPerP2SH+1; i++ {
+		w := NewWallet()
+		compressed = append(compressed, w.PubKey)
+		uncompressed = append(uncompressed, pubKeyEncodings(&w.Private.PublicKey)[1])
+	}
+
+	if _, err := NewMultiSigScript(1, compressed); err == nil {
+		t.Fatalf("%d pubkeys accepted", len(compressed))
+	}
+	if _, err := NewMultiSigScript(1, uncompressed[:8]); err == nil {
+		t.Fatal("multisig script with 8 uncompressed pubkeys accepted")
+	}
+	script, err := NewMultiSigScript(1, uncompressed[:7])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok := ParseMultiSigScript(script); !ok {
+		t.Fatal("multisig script with 7 uncompressed pubkeys can not be parsed")
+	}
+}
+
+// 15-of-15的多重签名地址，收到的币要能花出去
+func TestSpendMultiSigAtLimit(t *testing.T) {
+	maturity := CoinbaseMaturity
+	CoinbaseMaturity = 0
+	defer func() { CoinbaseMaturity = maturity }()
+
+	ws := &Wallets{WalletsMap: make(map[string]*Wallet), RedeemScripts: make(map[string][]byte)}
+	var pubKeys [][]byte
+	for i := 0; i < maxPubKeysPerP2SH; i++ {
+		w := NewWallet()
+		ws.WalletsMap[w.NewAddress()] = w
+		pubKeys = append(pubKeys, w.PubKey)
+	}
+	redeemScript, err := NewMultiSigScript(len(pubKeys), pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, parsed, ok := ParseMultiSigScript(redeemScript)
+	if !ok || m != maxPubKeysPerP2SH || len(parsed) != maxPubKeysPerP2SH {
+		t.Fatalf("ParseMultiSigScript() = %d, %d pubkeys, %v", m, len(parsed), ok)
+	}
+	address := ScriptHashToAddr(HashPubKey(redeemScript))
+	ws.RedeemScripts[address] = redeemScript
+
+	bc := newTestBlockChain(t, NewWallet())
+	if bc.AddBlock([]*Transaction{NewCoinBaseTx(address, "", 1, 0)}) == nil {
+		t.Fatal("mine block 1 failed")
+	}
+
+	tx := NewUnsignedTransaction(address, []*Payment{{To: NewWallet().NewAddress(), Amount: SatoshiPerBitcoin}},
+		1000, DefaultCoinSelect, bc)
+	if tx == nil {
+		t.Fatal("create tx failed")
+	}
+	prevTxs, err := bc.FindPrevTxs(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptx, err := NewPartialTx(tx, ws, prevTxs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ptx.Sign(ws); err != nil {
+		t.Fatal(err)
+	}
+	final, err := ptx.Finalize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bc.VerifyTransaction(final) {
+		t.Fatal("15-of-15 multisig spend rejected")
+	}
+}
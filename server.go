@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// 节点之间的网络通信，参考比特币的协议：
+//  1. version   握手，交换各自的区块高度
+//  2. getblocks 请求对方从某个高度之后的所有区块hash
+//  3. inv       告诉对方自己有哪些区块/交易(只有hash)
+//  4. getdata   根据hash请求具体的区块/交易
+//  5. block     发送区块
+//  6. tx        发送交易
+// 每条消息都是一次独立的TCP连接，前commandLength字节是命令名，后面是gob编码的消息体
+// 同一台机器上运行多个节点时，每个节点要在单独的目录下启动，各自使用自己的blockChain.db
+
+const (
+	protocol      = "tcp"
+	nodeVersion   = 1
+	commandLength = 12
+	// 种子节点，新节点启动后先和它握手
+	seedNode = "localhost:3000"
+	// 一条消息的最大长度，超过的直接丢弃，避免对方一直发数据把内存耗尽
+	maxMessageSize = 4 << 20
+	// 读取一条消息的超时时间，对方连上之后不发数据也不关闭连接时不会一直占着goroutine
+	readTimeout = 30 * time.Second
+	// 一条inv消息最多包含的hash数量，更多的区块等下载完这一批之后再请求
+	maxInvItems = 500
+	// 交易池中的交易达到这个数量就开始挖矿
+	mineTxThreshold = 10
+	// 交易池中有交易时，最多等这么久就开始挖矿
+	mineInterval = 30 * time.Second
+)
+
+type Server struct {
+	bc *BlockChain
+	// 当前节点的地址
+	nodeAddress string
+	// 矿工地址，为空表示当前节点不挖矿
+	minerAddress string
+	// 已知的节点
+	knownNodes []string
+	// 正在从各个节点下载的区块，map[节点地址]
+	blocksInTransit map[string]*blockDownload
+	// 还没有被打包的交易
+	mempool *Mempool
+	// 通知挖矿goroutine马上开始挖矿
+	mineSignal chan struct{}
+	// 每个连接都在单独的goroutine中处理，用锁保证区块链和节点状态一次只被一条消息修改
+	//  挖矿在单独的goroutine中进行，只在取交易和提交区块时加锁
+	mu sync.Mutex
+}
+
+// 正在从一个节点下载的区块
+type blockDownload struct {
+	// 还没有请求的区块，按高度从低到高排列，收到一个再请求下一个
+	queue [][]byte
+	// 对方的inv达到了maxInvItems，这一批下载完之后还要继续请求后面的区块
+	more bool
+}
+
+type version struct {
+	Version    int
+	BestHeight uint64
+	AddrFrom   string
+}
+
+type getBlocks struct {
+	AddrFrom string
+	// 请求方主链的区块定位器，只需要返回分叉点之后的区块
+	Locator [][]byte
+}
+
+type inv struct {
+	AddrFrom string
+	Type     string // "block" 或者 "tx"
+	Items    [][]byte
+}
+
+type getData struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+type blockMsg struct {
+	AddrFrom string
+	Block    []byte
+}
+
+type txMsg struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+func NewServer(bc *BlockChain, port, minerAddress string) *Server {
+	return &Server{
+		bc:           bc,
+		nodeAddress:  fmt.Sprintf("localhost:%s", port),
+		minerAddress: minerAddress,
+		knownNodes:   []string{seedNode},
+		mempool:      NewMempool(bc, true),
+
+		blocksInTransit: make(map[string]*blockDownload),
+		mineSignal:      make(chan struct{}, 1),
+	}
+}
+
+// 启动节点，监听端口并处理其他节点发来的消息
+func (s *Server) Start() {
+	ln, err := net.Listen(protocol, s.nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer ln.Close()
+	log.Printf("node %s started, best height: %d\n", s.nodeAddress, s.bc.GetBestHeight())
+
+	// 不是种子节点的话，先和种子节点握手
+	if s.nodeAddress != seedNode {
+		s.mu.Lock()
+		s.sendVersion(seedNode)
+		s.mu.Unlock()
+	}
+	if s.minerAddress != "" {
+		go s.miner()
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+func commandToBytes(command string) []byte {
+	var data [commandLength]byte
+	copy(data[:], command)
+	return data[:]
+}
+
+func bytesToCommand(data []byte) string {
+	return string(bytes.TrimRight(data, "\x00"))
+}
+
+func gobEncode(data interface{}) []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(data)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func gobDecode(data []byte, v interface{}) error {
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	return decoder.Decode(v)
+}
+
+func (s *Server) isKnownNode(addr string) bool {
+	for _, node := range s.knownNodes {
+		if node == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) sendData(addr string, data []byte) {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		log.Printf("node %s is not available\n", addr)
+		// 连不上的节点从已知节点中删掉
+		var nodes []string
+		for _, node := range s.knownNodes {
+			if node != addr {
+				nodes = append(nodes, node)
+			}
+		}
+		s.knownNodes = nodes
+		return
+	}
+	defer conn.Close()
+
+	_, err = io.Copy(conn, bytes.NewReader(data))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (s *Server) sendCommand(addr, command string, payload interface{}) {
+	request := append(commandToBytes(command), gobEncode(payload)...)
+	s.sendData(addr, request)
+}
+
+func (s *Server) sendVersion(addr string) {
+	s.sendCommand(addr, "version", version{
+		Version:    nodeVersion,
+		BestHeight: s.bc.GetBestHeight(),
+		AddrFrom:   s.nodeAddress,
+	})
+}
+
+func (s *Server) sendGetBlocks(addr string) {
+	s.sendCommand(addr, "getblocks", getBlocks{AddrFrom: s.nodeAddress, Locator: s.bc.BlockLocator()})
+}
+
+func (s *Server) sendInv(addr, kind string, items [][]byte) {
+	s.sendCommand(addr, "inv", inv{AddrFrom: s.nodeAddress, Type: kind, Items: items})
+}
+
+func (s *Server) sendGetData(addr, kind string, id []byte) {
+	s.sendCommand(addr, "getdata", getData{AddrFrom: s.nodeAddress, Type: kind, ID: id})
+}
+
+func (s *Server) sendBlock(addr string, block *Block) {
+	s.sendCommand(addr, "block", blockMsg{AddrFrom: s.nodeAddress, Block: block.Serialize()})
+}
+
+func (s *Server) sendTx(addr string, tx *Transaction) {
+	s.sendCommand(addr, "tx", txMsg{AddrFrom: s.nodeAddress, Transaction: tx.Serialize()})
+}
+
+// 把区块/交易的hash广播给除了from以外的所有已知节点
+func (s *Server) broadcastInv(from, kind string, id []byte) {
+	for _, node := range s.knownNodes {
+		if node != s.nodeAddress && node != from {
+			s.sendInv(node, kind, [][]byte{id})
+		}
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	err := conn.SetReadDeadline(time.Now().Add(readTimeout))
+	if err != nil {
+		conn.Close()
+		log.Println(err)
+		return
+	}
+	// 多读一个字节，读到了就说明消息超过了最大长度
+	request, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	conn.Close()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if len(request) > maxMessageSize {
+		log.Printf("message from %s exceeds %d bytes\n", conn.RemoteAddr(), maxMessageSize)
+		return
+	}
+	if len(request) < commandLength {
+		log.Println("invalid message")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	command := bytesToCommand(request[:commandLength])
+	payload := request[commandLength:]
+	log.Printf("received %s command\n", command)
+
+	switch command {
+	case "version":
+		err = s.handleVersion(payload)
+	case "getblocks":
+		err = s.handleGetBlocks(payload)
+	case "inv":
+		err = s.handleInv(payload)
+	case "getdata":
+		err = s.handleGetData(payload)
+	case "block":
+		err = s.handleBlock(payload)
+	case "tx":
+		err = s.handleTx(payload)
+	default:
+		err = fmt.Errorf("unknown command %s", command)
+	}
+	if err != nil {
+		log.Printf("handle %s failed: %v\n", command, err)
+	}
+}
+
+// 握手：对方比自己高就请求区块，自己比对方高就回一个version让对方来请求
+func (s *Server) handleVersion(payload []byte) error {
+	var msg version
+	err := gobDecode(payload, &msg)
+	if err != nil {
+		return err
+	}
+
+	myHeight := s.bc.GetBestHeight()
+	if myHeight < msg.BestHeight {
+		s.sendGetBlocks(msg.AddrFrom)
+	} else if myHeight > msg.BestHeight {
+		s.sendVersion(msg.AddrFrom)
+	}
+
+	if !s.isKnownNode(msg.AddrFrom) {
+		s.knownNodes = append(s.knownNodes, msg.AddrFrom)
+	}
+	return nil
+}
+
+// 返回分叉点之后的区块hash，按高度从低到高排列，请求方按顺序下载
+//  一次最多返回maxInvItems个，请求方下载完之后再请求后面的
+func (s *Server) handleGetBlocks(payload []byte) error {
+	var msg getBlocks
+	err := gobDecode(payload, &msg)
+	if err != nil {
+		return err
+	}
+
+	hashes := s.bc.HashesAfterLocator(msg.Locator, maxInvItems)
+	if len(hashes) > 0 {
+		s.sendInv(msg.AddrFrom, "block", hashes)
+	}
+	return nil
+}
+
+func (s *Server) handleInv(payload []byte) error {
+	var msg inv
+	err := gobDecode(payload, &msg)
+	if err != nil {
+		return err
+	}
+	log.Printf("received inventory with %d %s\n", len(msg.Items), msg.Type)
+	if len(msg.Items) > maxInvItems {
+		return fmt.Errorf("inventory with %d items exceeds %d", len(msg.Items), maxInvItems)
+	}
+
+	switch msg.Type {
+	case "block":
+		// 过滤掉已经有的区块，剩下的一个一个按顺序请求，每个节点的下载队列是分开的
+		var items [][]byte
+		for _, hash := range msg.Items {
+			if _, err := s.bc.GetBlockByHash(hash); err != nil {
+				items = append(items, hash)
+			}
+		}
+		if len(items) == 0 {
+			return nil
+		}
+		s.sendGetData(msg.AddrFrom, "block", items[0])
+		s.blocksInTransit[msg.AddrFrom] = &blockDownload{
+			queue: items[1:],
+			more:  len(msg.Items) == maxInvItems,
+		}
+	case "tx":
+		for _, txID := range msg.Items {
+			if !s.mempool.Has(txID) {
+				s.sendGetData(msg.AddrFrom, "tx", txID)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleGetData(payload []byte) error {
+	var msg getData
+	err := gobDecode(payload, &msg)
+	if err != nil {
+		return err
+	}
+
+	switch msg.Type {
+	case "block":
+		block, err := s.bc.GetBlockByHash(msg.ID)
+		if err != nil {
+			return err
+		}
+		s.sendBlock(msg.AddrFrom, block)
+	case "tx":
+		tx := s.mempool.Get(msg.ID)
+		if tx == nil {
+			return fmt.Errorf("tx %x not found in mempool", msg.ID)
+		}
+		s.sendTx(msg.AddrFrom, tx)
+	}
+	return nil
+}
+
+// 收到区块，校验通过后加到区块链上，然后继续请求下一个区块
+func (s *Server) handleBlock(payload []byte) error {
+	var msg blockMsg
+	err := gobDecode(payload, &msg)
+	if err != nil {
+		return err
+	}
+
+	block, err := DeserializeBlock(msg.Block)
+	if err != nil {
+		return err
+	}
+	log.Printf("received block %x at height %d\n", block.Hash, block.Height)
+
+	disconnected, err := s.bc.ProcessBlock(block)
+	if err == ErrOrphanBlock {
+		// 缺少前面的区块，把自己的区块定位器发给对方，从分叉点开始同步
+		delete(s.blocksInTransit, msg.AddrFrom)
+		s.sendGetBlocks(msg.AddrFrom)
+		return nil
+	}
+	if err != nil {
+		// 出错的话这个节点后面的区块也接不上了
+		delete(s.blocksInTransit, msg.AddrFrom)
+		return err
+	}
+
+	// 已经打包的交易以及和它们冲突的交易从交易池中删掉，重组时断开的交易放回交易池
+	s.mempool.RemoveBlockTxs(block)
+	s.mempool.AddDisconnectedTxs(disconnected)
+
+	download := s.blocksInTransit[msg.AddrFrom]
+	if download != nil && len(download.queue) > 0 {
+		s.sendGetData(msg.AddrFrom, "block", download.queue[0])
+		download.queue = download.queue[1:]
+		return nil
+	}
+	delete(s.blocksInTransit, msg.AddrFrom)
+	if download != nil && download.more {
+		// 这一批下载完了，对方还有更多的区块
+		s.sendGetBlocks(msg.AddrFrom)
+		return nil
+	}
+	// 同步完成，把最新的区块告诉其他节点
+	s.broadcastInv(msg.AddrFrom, "block", block.Hash)
+	return nil
+}
+
+// 收到交易，校验通过后放到交易池并转发给其他节点
+//  矿工节点的交易池中的交易达到mineTxThreshold时通知挖矿goroutine
+func (s *Server) handleTx(payload []byte) error {
+	var msg txMsg
+	err := gobDecode(payload, &msg)
+	if err != nil {
+		return err
+	}
+
+	tx, err := DeserializeTransaction(msg.Transaction)
+	if err != nil {
+		return err
+	}
+	if s.mempool.Has(tx.TxID) {
+		return nil
+	}
+	err = s.mempool.Add(tx)
+	if err != nil {
+		return err
+	}
+	log.Printf("tx %x added to mempool, %d pending\n", tx.TxID, s.mempool.Count())
+
+	s.broadcastInv(msg.AddrFrom, "tx", tx.TxID)
+
+	if s.minerAddress != "" && s.mempool.Count() >= mineTxThreshold {
+		select {
+		case s.mineSignal <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// 挖矿goroutine，交易池中的交易足够多或者每隔mineInterval挖一个区块
+func (s *Server) miner() {
+	ticker := time.NewTicker(mineInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.mineSignal:
+		case <-ticker.C:
+		}
+		s.mineBlock()
+	}
+}
+
+// 把交易池中的交易打包成一个区块，挖到之后广播给所有节点
+//  1. 加锁，从交易池中取出交易，记下接在哪个区块后面
+//  2. 不加锁计算工作量证明，这期间其他消息照常处理
+//  3. 加锁，主链的最后一个区块没有变化才提交，否则丢弃，交易留在交易池中等下一次挖矿
+func (s *Server) mineBlock() {
+	s.mu.Lock()
+	txs, fees := s.mempool.SelectTxs()
+	lastBlock, err := s.bc.GetBlockByHash(s.bc.tail)
+	if err != nil {
+		log.Panic(err)
+	}
+	bits := s.bc.nextDifficulty(lastBlock)
+	s.mu.Unlock()
+	if len(txs) == 0 {
+		return
+	}
+
+	coinbase := NewCoinBaseTx(s.minerAddress, fmt.Sprintf("mined by node %s", s.nodeAddress), lastBlock.Height+1, fees)
+	if coinbase == nil {
+		return
+	}
+	block := NewBlock(append([]*Transaction{coinbase}, txs...), lastBlock.Hash, lastBlock.Height+1, bits)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !bytes.Equal(s.bc.tail, lastBlock.Hash) {
+		log.Printf("chain tip changed while mining, block %x discarded\n", block.Hash)
+		return
+	}
+	_, err = s.bc.ProcessBlock(block)
+	if err != nil {
+		log.Println("add block failed:", err)
+		return
+	}
+	s.mempool.RemoveBlockTxs(block)
+	s.broadcastInv("", "block", block.Hash)
+}
+
+// 把交易发送给指定的节点，由它来校验、转发和打包
+func SendTxToNode(addr string, tx *Transaction) error {
+	conn, err := net.Dial(protocol, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := append(commandToBytes("tx"), gobEncode(txMsg{AddrFrom: "", Transaction: tx.Serialize()})...)
+	_, err = io.Copy(conn, bytes.NewReader(request))
+	return err
+}
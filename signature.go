@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/btcsuite/btcd/btcec"
+	"log"
+	"math/big"
+)
+
+// 公钥和签名的编码，和BTC一样
+//  1. 公钥使用SEC1编码：压缩格式0x02/0x03 + X，非压缩格式0x04 + X + Y，X和Y都补齐到曲线的字节长度
+//  2. 签名使用DER编码：0x30 总长度 0x02 r长度 r 0x02 s长度 s，并且s必须在曲线阶数的一半以内(low-S)
+//  以前的公钥是X和Y直接拼接，签名是r和s直接拼接，开头是0的时候会丢掉一个字节，拆分时就错位了
+
+const (
+	pubKeyCompressedEven byte = 0x02
+	pubKeyCompressedOdd  byte = 0x03
+	pubKeyUncompressed   byte = 0x04
+
+	derSequence byte = 0x30
+	derInteger  byte = 0x02
+)
+
+// 钱包中记录的曲线名字
+const (
+	// 和BTC一样的曲线，新创建的钱包都用这个
+	CurveSecp256k1 = "secp256k1"
+	// 旧版本的钱包用的曲线，生成的地址和BTC的工具对不上
+	CurveP256 = "P-256"
+)
+
+// 校验签名时支持的曲线，公钥的编码中没有曲线的信息，所以每个都要试一下
+var signatureCurves = []elliptic.Curve{btcec.S256(), elliptic.P256()}
+
+// 根据名字找到曲线，旧版本的钱包没有记录曲线，都是P-256
+func curveByName(name string) (elliptic.Curve, error) {
+	switch name {
+	case CurveSecp256k1:
+		return btcec.S256(), nil
+	case CurveP256, "":
+		return elliptic.P256(), nil
+	default:
+		return nil, fmt.Errorf("unknown curve %s", name)
+	}
+}
+
+// 曲线上每个坐标的字节长度
+func coordinateLength(curve elliptic.Curve) int {
+	return (curve.Params().BitSize + 7) / 8
+}
+
+// 公钥序列化成SEC1压缩格式，新创建的钱包都用这个格式
+func PubKeyBytes(pubKey *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(pubKey.Curve, pubKey.X, pubKey.Y)
+}
+
+// 同一个公钥所有可能的序列化格式，旧钱包的地址是由旧格式的公钥生成的
+//  签名时要找到和锁定脚本中公钥hash对应的那一个
+func pubKeyEncodings(pubKey *ecdsa.PublicKey) [][]byte {
+	size := coordinateLength(pubKey.Curve)
+	x := pubKey.X.FillBytes(make([]byte, size))
+	y := pubKey.Y.FillBytes(make([]byte, size))
+	return [][]byte{
+		PubKeyBytes(pubKey),
+		append(append([]byte{pubKeyUncompressed}, x...), y...),
+		append(x, y...),
+	}
+}
+
+// 严格解析公钥，只接受SEC1的压缩、非压缩格式，以及旧钱包中X和Y拼接的格式
+//  点必须在指定的曲线上
+func ParsePubKey(data []byte, curve elliptic.Curve) (*ecdsa.PublicKey, error) {
+	size := coordinateLength(curve)
+
+	var x, y *big.Int
+	switch {
+	case len(data) == 1+size && (data[0] == pubKeyCompressedEven || data[0] == pubKeyCompressedOdd):
+		x, y = decompressPubKey(data, curve)
+	case len(data) == 1+2*size && data[0] == pubKeyUncompressed:
+		x = new(big.Int).SetBytes(data[1 : 1+size])
+		y = new(big.Int).SetBytes(data[1+size:])
+	case len(data) == 2*size:
+		// 旧钱包的格式，没有前缀
+		x = new(big.Int).SetBytes(data[:size])
+		y = new(big.Int).SetBytes(data[size:])
+	default:
+		return nil, fmt.Errorf("invalid pubkey length %d", len(data))
+	}
+
+	if x == nil || !curve.IsOnCurve(x, y) {
+		return nil, errors.New("pubkey is not on curve")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// 根据压缩格式的X算出Y，secp256k1的a是0，elliptic包只支持a是-3的曲线
+func decompressPubKey(data []byte, curve elliptic.Curve) (*big.Int, *big.Int) {
+	koblitz, ok := curve.(*btcec.KoblitzCurve)
+	if !ok {
+		return elliptic.UnmarshalCompressed(curve, data)
+	}
+	pubKey, err := btcec.ParsePubKey(data, koblitz)
+	if err != nil {
+		return nil, nil
+	}
+	return pubKey.X, pubKey.Y
+}
+
+// 在所有支持的曲线上解析公钥，返回所有合法的结果
+func parsePubKeyOnAnyCurve(data []byte) ([]*ecdsa.PublicKey, error) {
+	var pubKeys []*ecdsa.PublicKey
+	var err error
+	for _, curve := range signatureCurves {
+		var pubKey *ecdsa.PublicKey
+		pubKey, err = ParsePubKey(data, curve)
+		if err == nil {
+			pubKeys = append(pubKeys, pubKey)
+		}
+	}
+	if len(pubKeys) == 0 {
+		return nil, err
+	}
+	return pubKeys, nil
+}
+
+// 对hash签名，返回DER编码的签名
+//  s大于阶数的一半时换成N-s，两个签名都有效，只保留小的那个，防止别人改签名改变交易的样子
+func SignHash(privateKey *ecdsa.PrivateKey, hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	n := privateKey.Curve.Params().N
+	if s.Cmp(halfOrder(n)) > 0 {
+		s.Sub(n, s)
+	}
+	return encodeSignatureDER(r, s)
+}
+
+func halfOrder(n *big.Int) *big.Int {
+	return new(big.Int).Rsh(n, 1)
+}
+
+// DER整数：大端，最高位是1时前面补一个0，否则会被当成负数
+func derIntegerBytes(n *big.Int) []byte {
+	b := n.Bytes()
+	if len(b) == 0 || b[0]&0x80 != 0 {
+		b = append([]byte{0x00}, b...)
+	}
+	return append([]byte{derInteger, byte(len(b))}, b...)
+}
+
+func encodeSignatureDER(r, s *big.Int) []byte {
+	body := append(derIntegerBytes(r), derIntegerBytes(s)...)
+	return append([]byte{derSequence, byte(len(body))}, body...)
+}
+
+// 严格解析DER签名，长度必须完全一致，整数不能是负数，不能有多余的前导0
+func parseSignatureDER(signature []byte) (*big.Int, *big.Int, error) {
+	// 最短 30 06 02 01 r 02 01 s，最长r和s都是33字节
+	if len(signature) < 8 || len(signature) > 72 {
+		return nil, nil, fmt.Errorf("invalid signature length %d", len(signature))
+	}
+	if signature[0] != derSequence {
+		return nil, nil, errors.New("signature is not a DER sequence")
+	}
+	if int(signature[1]) != len(signature)-2 {
+		return nil, nil, errors.New("signature has wrong length")
+	}
+
+	rest := signature[2:]
+	r, rest, err := parseDERInteger(rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature r: %v", err)
+	}
+	s, rest, err := parseDERInteger(rest)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature s: %v", err)
+	}
+	if len(rest) != 0 {
+		return nil, nil, errors.New("signature has trailing bytes")
+	}
+	return r, s, nil
+}
+
+func parseDERInteger(data []byte) (*big.Int, []byte, error) {
+	if len(data) < 2 || data[0] != derInteger {
+		return nil, nil, errors.New("not a DER integer")
+	}
+	length := int(data[1])
+	if length == 0 || len(data) < 2+length {
+		return nil, nil, errors.New("wrong integer length")
+	}
+	value := data[2 : 2+length]
+	if value[0]&0x80 != 0 {
+		return nil, nil, errors.New("negative integer")
+	}
+	if length > 1 && value[0] == 0x00 && value[1]&0x80 == 0 {
+		return nil, nil, errors.New("integer has unnecessary leading zero")
+	}
+	return new(big.Int).SetBytes(value), data[2+length:], nil
+}
+
+// 用公钥校验签名，公钥和签名的编码都必须合法，s必须是low-S
+//  公钥可能是secp256k1的，也可能是旧钱包P-256的，任意一个曲线上校验通过就可以
+func verifySignature(pubKey, hash, signature []byte) bool {
+	pubKeys, err := parsePubKeyOnAnyCurve(pubKey)
+	if err != nil {
+		return false
+	}
+	r, s, err := parseSignatureDER(signature)
+	if err != nil {
+		return false
+	}
+
+	for _, pubKeyOrigin := range pubKeys {
+		n := pubKeyOrigin.Curve.Params().N
+		if r.Sign() == 0 || s.Sign() == 0 || r.Cmp(n) >= 0 || s.Cmp(halfOrder(n)) > 0 {
+			continue
+		}
+		if ecdsa.Verify(pubKeyOrigin, hash, r, s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+)
+
+// 出块奖励按区块高度减半，和BTC一样，总量是有上限的
+//  参考demo/totalBtc.go：每隔HalvingInterval个区块奖励减半，减到0之后就不再产生新币
+
+const (
+	// 创世块的出块奖励12.5个BTC，单位是聪
+	DefaultInitialSubsidy int64 = 12.5 * SatoshiPerBitcoin
+	// 每隔多少个区块出块奖励减半
+	DefaultHalvingInterval = 210000
+
+	initialSubsidyEnv  = "INITIAL_SUBSIDY"
+	halvingIntervalEnv = "HALVING_INTERVAL"
+)
+
+// 出块奖励的参数，可以用环境变量INITIAL_SUBSIDY(单位是BTC)和HALVING_INTERVAL修改，方便测试减半
+//  和COINBASE_MATURITY一样，所有节点必须使用相同的值，否则对挖矿交易金额是否有效的判断就不一致了
+var (
+	InitialSubsidy  int64  = DefaultInitialSubsidy
+	HalvingInterval uint64 = DefaultHalvingInterval
+)
+
+func init() {
+	if value, ok := os.LookupEnv(halvingIntervalEnv); ok {
+		interval, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || interval == 0 {
+			log.Panicf("%s %s is invalid", halvingIntervalEnv, value)
+		}
+		HalvingInterval = interval
+	}
+	if value, ok := os.LookupEnv(initialSubsidyEnv); ok {
+		subsidy, err := ParseAmount(value)
+		if err != nil || subsidy == 0 {
+			log.Panicf("%s %s is invalid", initialSubsidyEnv, value)
+		}
+		InitialSubsidy = subsidy
+	}
+	// 总量上限大约是InitialSubsidy*HalvingInterval*2，不能溢出
+	if InitialSubsidy > math.MaxInt64/2/int64(HalvingInterval) {
+		log.Panicf("%s %s is too large for %s %d", initialSubsidyEnv, FormatAmount(InitialSubsidy),
+			halvingIntervalEnv, HalvingInterval)
+	}
+}
+
+// 计算指定高度区块的出块奖励，单位是聪
+//  每减半一次右移一位，右移到0之后奖励就没有了
+func Subsidy(height uint64) int64 {
+	halvings := height / HalvingInterval
+	if halvings >= 63 {
+		return 0
+	}
+	return InitialSubsidy >> halvings
+}
+
+// 从创世块到指定高度(包括)一共产生的出块奖励，不包括交易费，交易费只是转移已有的币
+func IssuedSupply(height uint64) int64 {
+	var total int64
+	for start := uint64(0); start <= height; start += HalvingInterval {
+		subsidy := Subsidy(start)
+		if subsidy == 0 {
+			break
+		}
+		// 这一个减半周期内已经出的块数
+		count := height - start + 1
+		if count > HalvingInterval {
+			count = HalvingInterval
+		}
+		total += int64(count) * subsidy
+	}
+	return total
+}
+
+// 理论上的总量上限，也就是所有减半周期的出块奖励之和
+func MaxSupply() int64 {
+	var total int64
+	for start := uint64(0); Subsidy(start) > 0; start += HalvingInterval {
+		total += int64(HalvingInterval) * Subsidy(start)
+	}
+	return total
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+)
+
+// 把减半间隔改成2个区块，测试结束后恢复
+func setShortHalvingInterval(t *testing.T) {
+	interval := HalvingInterval
+	HalvingInterval = 2
+	t.Cleanup(func() { HalvingInterval = interval })
+}
+
+func TestSubsidyShortHalvingInterval(t *testing.T) {
+	setShortHalvingInterval(t)
+
+	s := InitialSubsidy
+	want := []int64{s, s, s / 2, s / 2, s / 4, s / 4}
+	for height, subsidy := range want {
+		if got := Subsidy(uint64(height)); got != subsidy {
+			t.Fatalf("Subsidy(%d) = %d, want %d", height, got, subsidy)
+		}
+	}
+	if got := IssuedSupply(4); got != 2*s+2*(s/2)+s/4 {
+		t.Fatalf("IssuedSupply(4) = %d", got)
+	}
+
+	var maxSupply int64
+	for subsidy := s; subsidy > 0; subsidy >>= 1 {
+		maxSupply += 2 * subsidy
+	}
+	if got := MaxSupply(); got != maxSupply {
+		t.Fatalf("MaxSupply() = %d, want %d", got, maxSupply)
+	}
+	if got := IssuedSupply(1000); got != maxSupply {
+		t.Fatalf("IssuedSupply(1000) = %d, want %d", got, maxSupply)
+	}
+}
+
+// 减半之后挖矿交易只能领取一半的出块奖励
+func TestCoinbaseAfterShortHalving(t *testing.T) {
+	setShortHalvingInterval(t)
+	bc := newTestBlockChain(t, NewWallet())
+	miner := NewWallet().NewAddress()
+
+	if bc.AddBlock([]*Transaction{NewCoinBaseTx(miner, "", 1, 0)}) == nil {
+		t.Fatal("mine block 1 failed")
+	}
+
+	coinbase := NewCoinBaseTx(miner, "", 2, 0)
+	if coinbase.TxOutputs[0].Amount != InitialSubsidy/2 {
+		t.Fatalf("coinbase at height 2 pays %d, want %d", coinbase.TxOutputs[0].Amount, InitialSubsidy/2)
+	}
+	coinbase.TxOutputs[0].Amount = InitialSubsidy
+	coinbase.TxID = coinbase.CalcHash()
+	if bc.AddBlock([]*Transaction{coinbase}) != nil {
+		t.Fatal("coinbase paying the subsidy before halving accepted")
+	}
+
+	if bc.AddBlock([]*Transaction{NewCoinBaseTx(miner, "", 2, 0)}) == nil {
+		t.Fatal("mine block 2 failed")
+	}
+}
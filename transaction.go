@@ -3,13 +3,12 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"log"
-	"math/big"
 	"strings"
 	"time"
 )
@@ -19,13 +18,24 @@ import (
 // 3. 创建挖矿交易
 // 4. 根据交易调整程序
 
-const Reward = 12.5
+const (
+	// LockTime小于这个值时表示区块高度，否则表示unix时间戳
+	LockTimeThreshold = 500000000
+	// input的Sequence为这个值时不启用任何时间锁
+	SequenceFinal uint32 = 0xffffffff
+	// Sequence的最高位为1时不启用相对时间锁
+	SequenceLockDisableFlag uint32 = 1 << 31
+	// Sequence的低16位表示相对时间锁的区块数，目前只支持按区块数锁定
+	SequenceLockMask uint32 = 0x0000ffff
+)
 
 type Transaction struct {
 	TxID      []byte      // 交易ID
 	TxInputs  []*TxInput  // 交易输入数组
 	TxOutputs []*TxOutput // 交易输出数组
 	Timestamp uint64      // 交易产生时间戳
+	// 锁定时间，为0时不限制，否则交易只能被打包进高度或者时间戳大于它的区块，参考IsFinal
+	LockTime uint64
 }
 
 type TxInput struct {
@@ -33,24 +43,24 @@ type TxInput struct {
 	Index int    // 引用的output的索引值
 	//Sig   string // 解锁脚本，我们用地址来模拟
 
-	// 真正的数字签名，由r，s拼成的[]byte
-	Signature []byte
+	// 解锁脚本，和引用的output的锁定脚本一起执行，P2PKH时是<签名> <公钥>
+	//  挖矿交易没有引用output，这里可以由矿工自由填写数据
+	ScriptSig []byte
 
-	// 约定，这里的PubKey不存储原始的公钥，而是存储X和Y拼接的字符串，在校验端重新拆分(参考r,s传递)
-	// 注意：是公钥，不是hash，也不是地址
-	PubKey []byte
+	// 序号，不是SequenceFinal时交易的LockTime才生效，最高位为0时低16位是相对时间锁
+	Sequence uint32
 }
 
 type TxOutput struct {
-	Amount float64 // 转账金额
+	Amount int64 // 转账金额，单位是聪
 	//PubKeyHash string  // 锁定脚本，我们用地址模拟
 
-	// 收款方的公钥hash，注意：是hash而不是公钥，也不是地址
-	PubKeyHash []byte
+	// 锁定脚本，花费这个output的input的解锁脚本必须能让它执行成功
+	ScriptPubKey []byte
 }
 
 // 给TxOutput提供一个创建方法，否则无法调用Lock
-func NewTxOutput(amount float64, address string) *TxOutput {
+func NewTxOutput(amount int64, address string) *TxOutput {
 	output := &TxOutput{
 		Amount: amount,
 	}
@@ -58,11 +68,28 @@ func NewTxOutput(amount float64, address string) *TxOutput {
 	return output
 }
 
-// 由于现在存储的字段是地址的公钥hash，所以无法直接创建TxOutput，
-//  为了能够得到公钥hash，我们需要处理一下，写一个Lock函数
+// 由于现在存储的字段是锁定脚本，所以无法直接创建TxOutput，
+//  为了能够从地址得到锁定脚本，我们需要处理一下，写一个Lock函数
 func (o *TxOutput) Lock(address string) {
 	// 真正的锁定动作！！！
-	o.PubKeyHash = GetPubKeyFromAddress(address)
+	o.ScriptPubKey = AddressToScript(address)
+}
+
+// output是否是锁定给这个公钥hash的P2PKH output
+func (o *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
+	hash, ok := ExtractPubKeyHash(o.ScriptPubKey)
+	return ok && bytes.Equal(hash, pubKeyHash)
+}
+
+// 锁定脚本对应的地址，不是标准脚本时返回false
+func (o *TxOutput) Address() (string, bool) {
+	if hash, ok := ExtractPubKeyHash(o.ScriptPubKey); ok {
+		return PubKeyHashToAddr(hash), true
+	}
+	if hash, ok := ExtractScriptHash(o.ScriptPubKey); ok {
+		return ScriptHashToAddr(hash), true
+	}
+	return "", false
 }
 
 // 添加交易的Hash ID（设置Tx的TxID）
@@ -78,6 +105,52 @@ func (tx *Transaction) SetHash() {
 	tx.TxID = hash[:]
 }
 
+// 重新计算交易的hash，用于校验其他节点发来的交易的TxID是否被篡改
+//  TxID是在签名之前生成的，计算时要把TxID和所有解锁脚本置空
+//  挖矿交易的解锁脚本是矿工填写的数据，不是签名，要参与计算
+func (tx *Transaction) CalcHash() []byte {
+	txCopy := &Transaction{
+		TxOutputs: tx.TxOutputs,
+		Timestamp: tx.Timestamp,
+		LockTime:  tx.LockTime,
+	}
+	for _, input := range tx.TxInputs {
+		txInput := &TxInput{
+			TxID:     input.TxID,
+			Index:    input.Index,
+			Sequence: input.Sequence,
+		}
+		if tx.IsCoinBase() {
+			txInput.ScriptSig = input.ScriptSig
+		}
+		txCopy.TxInputs = append(txCopy.TxInputs, txInput)
+	}
+	txCopy.SetHash()
+	return txCopy.TxID
+}
+
+// 序列化交易，用于网络传输
+func (tx *Transaction) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(tx)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+// 反序列化交易，数据可能来自其他节点，出错时返回错误
+func DeserializeTransaction(data []byte) (*Transaction, error) {
+	var tx Transaction
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&tx)
+	if err != nil {
+		return nil, err
+	}
+	return &tx, nil
+}
+
 // 实现一个函数，判断当前的交易是否为挖矿交易
 func (tx *Transaction) IsCoinBase() bool {
 	// 1. 交易的input只有一个
@@ -92,25 +165,41 @@ func (tx *Transaction) IsCoinBase() bool {
 	return false
 }
 
-// 创建挖矿奖励的交易
-func NewCoinBaseTx(addr string, data string) *Transaction {
+// 创建挖矿奖励的交易，矿工除了出块奖励，还可以拿到区块中所有交易的交易费
+//  出块奖励随高度减半，height是挖矿交易所在区块的高度
+//  tag是矿工的标签，和高度、随机的ExtraNonce一起写到ScriptSig中，参考CoinbaseData
+func NewCoinBaseTx(addr string, tag string, height uint64, fees int64) *Transaction {
 	// 1. 校验地址
 	if !IsValidAddress(addr) {
 		log.Printf("address %s is invalid\n", addr)
 		return nil
 	}
+	if len(tag) > maxCoinbaseTagLength {
+		log.Printf("coinbase tag is longer than %d bytes\n", maxCoinbaseTagLength)
+		return nil
+	}
+	extraNonce := make([]byte, 8)
+	_, err := rand.Read(extraNonce)
+	if err != nil {
+		log.Panic(err)
+	}
+	coinbaseData := &CoinbaseData{
+		Height:     height,
+		ExtraNonce: binary.LittleEndian.Uint64(extraNonce),
+		Tag:        []byte(tag),
+	}
 
 	// 挖矿交易的特点:
 	// 1. 只有一个input
 	// 2. 无需引用交易id
 	// 3. 无需引用output 的 index
 
-	// 矿工由于挖矿时无需指定签名，所以PubKey这个字段可以由矿工自由填写数据，一般是填写矿池的名字
+	// 矿工由于挖矿时无需指定签名，所以ScriptSig这个字段可以由矿工自由填写数据，一般是填写矿池的名字
 	input := &TxInput{
 		TxID:      []byte{},
 		Index:     -1,
-		Signature: nil,
-		PubKey:    []byte(data),
+		ScriptSig: coinbaseData.Script(),
+		Sequence:  SequenceFinal,
 	}
 	//output := &TxOutput{
 	//	Amount:     Reward,
@@ -118,7 +207,7 @@ func NewCoinBaseTx(addr string, data string) *Transaction {
 	//}
 
 	// 新的创建方法
-	output := NewTxOutput(Reward, addr)
+	output := NewTxOutput(Subsidy(height)+fees, addr)
 
 	// 对于挖矿交易来说，只有一个input和一个output
 	tx := &Transaction{
@@ -130,56 +219,184 @@ func NewCoinBaseTx(addr string, data string) *Transaction {
 	return tx
 }
 
+// 转账的一个收款方，一笔交易可以同时转给多个收款方
+type Payment struct {
+	To     string
+	Amount int64
+}
+
 // 创建普通的转账交易
-//  1. 找到最合理的UTXO集合 map[string][]int64
+//  1. 按选币策略strategy找到要花费的UTXO，参考SelectCoins
 //  2. 将这些UTXO逐一转成input
-//  3. 创建outputs
-//  4. 如果有零钱要找零
-func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transaction {
-	// 1. 校验地址
-	if !IsValidAddress(from) {
-		log.Printf("address %s is invalid\n", from)
-		return nil
-	} else if !IsValidAddress(to) {
-		log.Printf("address %s is invalid\n", to)
-		return nil
-	}
-
+//  3. 每个收款方创建一个output
+//  4. 如果有零钱要找零，交易费不单独记录，input总额减去output总额就是交易费
+func NewTransaction(from string, payments []*Payment, fee int64, strategy string, bc *BlockChain) *Transaction {
 	// 1. 创建交易之后要进行数字签名->所以需要私钥->打开钱包"NewWallets()"
 	// 2. 找到自己的钱包，根据地址返回自己的wallet
 	// 3. 得到对应的公钥、私钥
 	ws := NewWallets()
 	wallet := ws.WalletsMap[from]
+	if wallet == nil && ws.IsWatchOnly(from) {
+		log.Printf("address %s is watch-only, can not spend from it, Tx create fail!\n", from)
+		return nil
+	}
 	if wallet == nil {
 		log.Printf("not found address %s, Tx create fail!\n", from)
 		return nil
 	}
-	pubKey := wallet.PubKey
+	if err := ws.CheckUnlocked(); err != nil {
+		log.Println(err)
+		return nil
+	}
 	privateKey := wallet.Private
 
-	// 传递公钥的hash，而不是传递地址
-	pubKeyHash := HashPubKey(pubKey)
+	tx := NewUnsignedTransaction(from, payments, fee, strategy, bc)
+	if tx == nil {
+		return nil
+	}
+
+	// 签名，交易创建的最后进行签名
+	bc.SignTransaction(tx, privateKey)
+
+	return tx
+}
+
+// 创建还没有签名的转账交易，from可以是普通地址，也可以是多重签名的P2SH地址
+//  多重签名的交易需要几个人分别签名，参考PartialTx
+func NewUnsignedTransaction(from string, payments []*Payment, fee int64, strategy string, bc *BlockChain) *Transaction {
+	// 1. 校验地址和金额
+	if !IsValidAddress(from) {
+		log.Printf("address %s is invalid\n", from)
+		return nil
+	}
+	need, ok := paymentsTotal(payments, fee)
+	if !ok {
+		return nil
+	}
+
+	// 传递锁定脚本，而不是传递地址
+	coins, totalAmount, err := SelectCoins(bc.FindCoins(AddressToScript(from)), need, strategy)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if coins == nil {
+		log.Printf("Insufficient balance, your: %s, need: %s\n", FormatAmount(totalAmount), FormatAmount(need))
+		return nil
+	}
+
+	return newPaymentTransaction(coins, payments, totalAmount-need, from)
+}
+
+// 从钱包中所有地址的UTXO一起选币，创建转账交易，每个input用它所属地址的私钥签名
+//  多重签名地址和只查看的地址不参与
+//  找零发到change，change为空时从HD钱包导出一个新地址，没有零钱时不会导出
+func NewWalletTransaction(payments []*Payment, fee int64, strategy, change string, bc *BlockChain) *Transaction {
+	if change != "" && !IsValidAddress(change) {
+		log.Printf("address %s is invalid\n", change)
+		return nil
+	}
+	need, ok := paymentsTotal(payments, fee)
+	if !ok {
+		return nil
+	}
+
+	ws := NewWallets()
+	if err := ws.CheckUnlocked(); err != nil {
+		log.Println(err)
+		return nil
+	}
+	// map[锁定脚本]钱包
+	owners := make(map[string]*Wallet)
+	var scripts [][]byte
+	for address, wallet := range ws.WalletsMap {
+		script := AddressToScript(address)
+		owners[string(script)] = wallet
+		scripts = append(scripts, script)
+	}
+
+	coins, totalAmount, err := SelectCoins(bc.FindCoins(scripts...), need, strategy)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	if coins == nil {
+		log.Printf("Insufficient wallet balance, your: %s, need: %s\n", FormatAmount(totalAmount), FormatAmount(need))
+		return nil
+	}
 
-	utxos, totalAmount := bc.FindNeedUTXOs(pubKeyHash, amount)
-	if totalAmount < amount {
-		log.Printf("Insufficient balance, your: %f, need: %f\n", totalAmount, amount)
+	if change == "" && totalAmount-need >= DustThreshold {
+		change, err = ws.CreateWallet()
+		if err != nil {
+			log.Printf("create change address failed: %v, use a designated change address instead\n", err)
+			return nil
+		}
+		log.Printf("change goes to new address %s\n", change)
+	}
+	tx := newPaymentTransaction(coins, payments, totalAmount-need, change)
+
+	// 每个用到的地址的私钥签一次，Sign只签自己的公钥hash对应的input
+	prevOutputs, err := UTXOSet{bc}.FindPrevOutputs(tx)
+	if err != nil {
+		log.Println(err)
 		return nil
 	}
+	signed := make(map[*Wallet]bool)
+	for _, coin := range coins {
+		wallet := owners[string(coin.ScriptPubKey)]
+		if signed[wallet] {
+			continue
+		}
+		tx.Sign(wallet.Private, prevOutputs)
+		signed[wallet] = true
+	}
+	return tx
+}
+
+// 校验所有的收款方和交易费，返回需要的总额
+func paymentsTotal(payments []*Payment, fee int64) (int64, bool) {
+	if len(payments) == 0 {
+		log.Println("no recipient, Tx create fail!")
+		return 0, false
+	}
+	if fee < 0 {
+		log.Printf("invalid fee %s\n", FormatAmount(fee))
+		return 0, false
+	}
+
+	need := fee
+	for _, payment := range payments {
+		if !IsValidAddress(payment.To) {
+			log.Printf("address %s is invalid\n", payment.To)
+			return 0, false
+		}
+		if payment.Amount <= 0 {
+			log.Printf("invalid amount %s to %s\n", FormatAmount(payment.Amount), payment.To)
+			return 0, false
+		}
+		// 每加一个都检查，收款方很多时总额也不会溢出
+		need += payment.Amount
+		if need > MaxSupply() {
+			log.Printf("total amount %s is more than the max supply\n", FormatAmount(need))
+			return 0, false
+		}
+	}
+	return need, true
+}
 
+// 用选好的UTXO创建交易，零钱change发到changeAddr
+func newPaymentTransaction(coins []*Coin, payments []*Payment, change int64, changeAddr string) *Transaction {
 	var inputs = make([]*TxInput, 0, 4)
 	var outputs = make([]*TxOutput, 0, 4)
 
 	// 创建交易输入，并将这些UTXO添加到inputs中
-	for txID, indexArray := range utxos {
-		for _, i := range indexArray {
-			input := &TxInput{
-				TxID:      []byte(txID),
-				Index:     i,
-				Signature: nil,
-				PubKey:    pubKey,
-			}
-			inputs = append(inputs, input)
+	for _, coin := range coins {
+		input := &TxInput{
+			TxID:     coin.TxID,
+			Index:    coin.Index,
+			Sequence: SequenceFinal,
 		}
+		inputs = append(inputs, input)
 	}
 
 	// 创建交易输出
@@ -187,12 +404,13 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 	//	Amount:     amount,
 	//	PubKeyHash: to,
 	//}
-	output := NewTxOutput(amount, to)
-	outputs = append(outputs, output)
+	for _, payment := range payments {
+		outputs = append(outputs, NewTxOutput(payment.Amount, payment.To))
+	}
 
-	// 找零
-	if totalAmount > amount {
-		output = NewTxOutput(totalAmount-amount, from)
+	// 找零，粉尘一样的零钱不找了，直接算作交易费
+	if change >= DustThreshold {
+		output := NewTxOutput(change, changeAddr)
 		outputs = append(outputs, output)
 	}
 
@@ -203,48 +421,84 @@ func NewTransaction(from, to string, amount float64, bc *BlockChain) *Transactio
 	}
 	tx.SetHash()
 
-	// 签名，交易创建的最后进行签名
-	bc.SignTransaction(tx, privateKey)
-
 	return tx
 }
 
-// 签名的具体实现，参数为：私钥、inputs里面所有引用的交易结构map[string]Transaction
-func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, prevTxs map[string]*Transaction) {
+// 计算交易费：所有input引用的output金额之和减去所有output金额之和
+//  每个金额和累加的总额都不能超过MaxSupply()，否则返回错误，避免溢出之后交易费看起来是正常的
+func (tx *Transaction) Fee(prevOutputs map[string]*TxOutput) (int64, error) {
+	if tx.IsCoinBase() {
+		return 0, nil
+	}
+
+	var inputAmount, outputAmount int64
+	var err error
+	for i, input := range tx.TxInputs {
+		if prevOutput, ok := prevOutputs[outpointKey(input.TxID, input.Index)]; ok {
+			inputAmount, err = AddAmount(inputAmount, prevOutput.Amount)
+			if err != nil {
+				return 0, fmt.Errorf("tx %x input %d: %v", tx.TxID, i, err)
+			}
+		}
+	}
+	for i, output := range tx.TxOutputs {
+		outputAmount, err = AddAmount(outputAmount, output.Amount)
+		if err != nil {
+			return 0, fmt.Errorf("tx %x output %d: %v", tx.TxID, i, err)
+		}
+	}
+	return inputAmount - outputAmount, nil
+}
+
+// 签名的具体实现，参数为：私钥、inputs里面所有引用的output map["TxID:index"]*TxOutput
+//  只给锁定在这个私钥对应的公钥hash上的input签名，解锁脚本为<签名> <公钥>
+func (tx *Transaction) Sign(privateKey *ecdsa.PrivateKey, prevOutputs map[string]*TxOutput) {
 
 	if tx.IsCoinBase() {
 		return
 	}
 
-	// 1. 创建一个当前交易的txCopy，使用函数：TrimmedCopy()，要把Signature和PubKey字段设为nil
-	txCopy := tx.TrimmedCopy()
-	// 2. 循环遍历txCopy的inputs，得到input所引用的output公钥hash
-	for i, input := range txCopy.TxInputs {
-		prevTx, ok := prevTxs[string(input.TxID)]
+	// 旧钱包的地址是用旧格式的公钥生成的，所以每种格式都要试一下
+	pubKeys := pubKeyEncodings(&privateKey.PublicKey)
+
+	for i, input := range tx.TxInputs {
+		// 1. 找到input所引用的output
+		prevOutput, ok := prevOutputs[outpointKey(input.TxID, input.Index)]
 		if !ok {
 			log.Panic("invalid tx")
 		}
-		txCopy.TxInputs[i].PubKey = prevTx.TxOutputs[input.Index].PubKeyHash
-
-		// 3. 生成要签名的数据，要签名的数据一定是hash值
-		// 3.1 我们对每一个input都要签名一次，签名的数据是由当前input引用的output的hash+当前的outputs（都承载在当前这个txCopy里面）
-		// 3.2 要对这个拼好的txCopy进行hash处理，SetHash得到TxID，这个TxID就是我们要签名的最终数据
-		txCopy.SetHash()
-		txCopy.TxInputs[i].PubKey = nil
-		signDataHash := txCopy.TxID
-
-		// 4. 执行签名动作得到r，s字节流
-		r, s, err := ecdsa.Sign(rand.Reader, privateKey, signDataHash)
-		if err != nil {
-			log.Panic(err)
+		var pubKey []byte
+		for _, encoding := range pubKeys {
+			if prevOutput.IsLockedWithKey(HashPubKey(encoding)) {
+				pubKey = encoding
+				break
+			}
 		}
+		if pubKey == nil {
+			continue
+		}
+
+		// 2. 生成要签名的数据，要签名的数据一定是hash值，参考SignatureHash
+		signDataHash := tx.SignatureHash(i, prevOutput.ScriptPubKey)
 
-		// 5. 放到我们所签名的input的Signature中
-		signature := append(r.Bytes(), s.Bytes()...)
-		tx.TxInputs[i].Signature = signature
+		// 3. 执行签名动作，放到我们所签名的input的解锁脚本中
+		signature := SignHash(privateKey, signDataHash)
+		tx.TxInputs[i].ScriptSig = NewP2PKHScriptSig(signature, pubKey)
 	}
 }
 
+// 计算第i个input要签名的数据
+//  1. 创建一个当前交易的txCopy，使用函数：TrimmedCopy()，要把所有input的解锁脚本设为nil
+//  2. 把第i个input的解锁脚本换成它引用的output的锁定脚本
+//  3. 对这个拼好的txCopy进行hash处理，SetHash得到TxID，这个TxID就是我们要签名的最终数据
+//  这样签名就覆盖了引用的output和当前交易所有的outputs
+func (tx *Transaction) SignatureHash(i int, prevScript []byte) []byte {
+	txCopy := tx.TrimmedCopy()
+	txCopy.TxInputs[i].ScriptSig = prevScript
+	txCopy.SetHash()
+	return txCopy.TxID
+}
+
 func (tx *Transaction) TrimmedCopy() *Transaction {
 	var inputs []*TxInput
 	var outputs []*TxOutput
@@ -252,14 +506,14 @@ func (tx *Transaction) TrimmedCopy() *Transaction {
 		inputs = append(inputs, &TxInput{
 			TxID:      input.TxID,
 			Index:     input.Index,
-			Signature: nil,
-			PubKey:    nil,
+			ScriptSig: nil,
+			Sequence:  input.Sequence,
 		})
 	}
 	for _, output := range tx.TxOutputs {
 		outputs = append(outputs, &TxOutput{
-			Amount:     output.Amount,
-			PubKeyHash: output.PubKeyHash,
+			Amount:       output.Amount,
+			ScriptPubKey: output.ScriptPubKey,
 		})
 	}
 	return &Transaction{
@@ -267,53 +521,43 @@ func (tx *Transaction) TrimmedCopy() *Transaction {
 		TxInputs:  inputs,
 		TxOutputs: outputs,
 		Timestamp: tx.Timestamp,
+		LockTime:  tx.LockTime,
 	}
 }
 
 // 分析校验
-//  所需要的数据：公钥、数据（txCopy，生成hash）、签名
-//  我们要对每一个签名过的input进行校验
-func (tx *Transaction) Verify(prevTxs map[string]*Transaction) bool {
+//  所需要的数据：每个input的解锁脚本、它引用的output的锁定脚本
+//  我们要对每一个input执行一遍脚本，参考VerifyScript
+func (tx *Transaction) Verify(prevOutputs map[string]*TxOutput) bool {
 	if tx.IsCoinBase() {
 		return true
 	}
 
-	// 1. 得到签名的数据
-	txCopy := tx.TrimmedCopy()
+	// 0. 金额校验：每个output和总额都在[0, MaxSupply()]之间，总额不能超过引用的output总额
+	if len(tx.TxInputs) == 0 {
+		return false
+	}
+	fee, err := tx.Fee(prevOutputs)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if fee < 0 {
+		log.Printf("tx %x outputs exceed inputs\n", tx.TxID)
+		return false
+	}
+
+	// 1. 用每个input的解锁脚本去解锁它引用的output
 	for i, input := range tx.TxInputs {
-		prevTx, ok := prevTxs[string(input.TxID)]
+		prevOutput, ok := prevOutputs[outpointKey(input.TxID, input.Index)]
 		if !ok {
-			log.Panic("invalid tx")
+			log.Printf("tx %x input %d references invalid output\n", tx.TxID, i)
+			return false
 		}
-		txCopy.TxInputs[i].PubKey = prevTx.TxOutputs[input.Index].PubKeyHash
-		txCopy.SetHash()
-		dataHash := txCopy.TxID
-
-		// 2. 得到Signature，反推回r，s
-		signature := input.Signature // 拆 r, s
-		// 3. 拆解PubKey，得到原生的公钥X，Y
-		pubKey := input.PubKey // 拆 X，Y
-
-		// 定义两个辅助的big.Int
-		r := new(big.Int)
-		s := new(big.Int)
-		// 拆分我们signature，前半部分给r，后半部分给s
-		idx := len(signature) / 2
-		r.SetBytes(signature[:idx])
-		s.SetBytes(signature[idx:])
-
-		// 定义两个辅助的big.Int
-		x := new(big.Int)
-		y := new(big.Int)
-		// 拆分我们pubKey，前半部分给X，后半部分给Y
-		idx = len(pubKey) / 2
-		x.SetBytes(pubKey[:idx])
-		y.SetBytes(pubKey[idx:])
-
-		pubKeyOrigin := ecdsa.PublicKey{elliptic.P256(), x, y}
-
-		// 4. Verify
-		if !ecdsa.Verify(&pubKeyOrigin, dataHash, r, s) {
+
+		err := VerifyScript(input.ScriptSig, prevOutput.ScriptPubKey, tx, i)
+		if err != nil {
+			log.Printf("tx %x input %d: %v\n", tx.TxID, i, err)
 			return false
 		}
 	}
@@ -321,22 +565,57 @@ func (tx *Transaction) Verify(prevTxs map[string]*Transaction) bool {
 	return true
 }
 
+// 交易能否被打包进指定高度和时间戳的区块
+//  LockTime为0，或者已经过了LockTime，或者所有input的Sequence都是SequenceFinal
+func (tx *Transaction) IsFinal(height, blockTime uint64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	limit := height
+	if tx.LockTime >= LockTimeThreshold {
+		limit = blockTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+
+	for _, input := range tx.TxInputs {
+		if input.Sequence != SequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
 func (tx *Transaction) String() string {
 	var lines = make([]string, 0, 16)
 	lines = append(lines, fmt.Sprintf("--- Transaction %x", tx.TxID))
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("    LockTime: %d", tx.LockTime))
+	}
 
 	for i, input := range tx.TxInputs {
 		lines = append(lines, fmt.Sprintf("    Input: %d", i))
 		lines = append(lines, fmt.Sprintf("      TxID: %x", input.TxID))
 		lines = append(lines, fmt.Sprintf("      Index: %d", input.Index))
-		lines = append(lines, fmt.Sprintf("      Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("      PubKey: %x", input.PubKey))
+		if c, err := ParseCoinbaseScript(input.ScriptSig); tx.IsCoinBase() && err == nil {
+			lines = append(lines, fmt.Sprintf("      Coinbase: height %d, extra nonce %016x, tag %q", c.Height, c.ExtraNonce, c.Tag))
+		} else if tx.IsCoinBase() {
+			lines = append(lines, fmt.Sprintf("      ScriptSig: %x", input.ScriptSig))
+		} else {
+			lines = append(lines, fmt.Sprintf("      ScriptSig: %s", DisasmScript(input.ScriptSig)))
+		}
+		lines = append(lines, fmt.Sprintf("      Sequence: %08x", input.Sequence))
 	}
 
 	for i, output := range tx.TxOutputs {
 		lines = append(lines, fmt.Sprintf("    Output: %d", i))
-		lines = append(lines, fmt.Sprintf("      Amount: %f", output.Amount))
-		lines = append(lines, fmt.Sprintf("      PubKeyHash: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("      Amount: %s", FormatAmount(output.Amount)))
+		lines = append(lines, fmt.Sprintf("      ScriptPubKey: %s", DisasmScript(output.ScriptPubKey)))
+		if address, ok := output.Address(); ok {
+			lines = append(lines, fmt.Sprintf("      Address: %s", address))
+		}
 	}
 
 	return strings.Join(lines, "\n")
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+)
+
+// 一个100聪的P2PKH input，output总额溢出int64之后只剩50，不能当成交易费为50的正常交易
+func TestFeeRejectsOverflowingOutputs(t *testing.T) {
+	w := NewWallet()
+	addr := w.NewAddress()
+	prevTxID := make([]byte, 32)
+	prevOutputs := map[string]*TxOutput{
+		outpointKey(prevTxID, 0): NewTxOutput(100, addr),
+	}
+
+	tx := &Transaction{
+		TxInputs: []*TxInput{{TxID: prevTxID, Index: 0, Sequence: SequenceFinal}},
+	}
+	for _, amount := range []int64{1 << 62, 1 << 62, 1 << 62, 1 << 62, 50} {
+		tx.TxOutputs = append(tx.TxOutputs, NewTxOutput(amount, addr))
+	}
+	tx.SetHash()
+	tx.Sign(w.Private, prevOutputs)
+
+	if fee, err := tx.Fee(prevOutputs); err == nil {
+		t.Fatalf("Fee() = %d, want error", fee)
+	}
+	if tx.Verify(prevOutputs) {
+		t.Fatal("Verify() = true, want false")
+	}
+}
+
+func TestFeeAcceptsValidOutputs(t *testing.T) {
+	w := NewWallet()
+	addr := w.NewAddress()
+	prevTxID := make([]byte, 32)
+	prevOutputs := map[string]*TxOutput{
+		outpointKey(prevTxID, 0): NewTxOutput(100, addr),
+	}
+
+	tx := &Transaction{
+		TxInputs:  []*TxInput{{TxID: prevTxID, Index: 0, Sequence: SequenceFinal}},
+		TxOutputs: []*TxOutput{NewTxOutput(30, addr), NewTxOutput(20, addr)},
+	}
+	tx.SetHash()
+	tx.Sign(w.Private, prevOutputs)
+
+	fee, err := tx.Fee(prevOutputs)
+	if err != nil || fee != 50 {
+		t.Fatalf("Fee() = %d, %v, want 50", fee, err)
+	}
+	if !tx.Verify(prevOutputs) {
+		t.Fatal("Verify() = false, want true")
+	}
+}
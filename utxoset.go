@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"github.com/boltdb/bolt"
+	"log"
+)
+
+// UTXO集合，把所有未花费的output按交易id单独存到utxoBucket里
+//  这样查询余额、转账找钱时就不用每次都遍历整个区块链了
+type UTXOSet struct {
+	bc *BlockChain
+}
+
+// 一笔交易中还没有被花费的output，map[output索引]output
+type UTXOs struct {
+	Outputs map[int]*TxOutput
+	// 交易所在区块的高度，用于检查相对时间锁
+	Height uint64
+	// 是否是挖矿交易的output，成熟之后才能花费
+	Coinbase bool
+}
+
+// 能否在指定高度的区块中花费，只有挖矿交易的output要检查，参考CoinbaseMaturity
+func (u *UTXOs) IsMature(height uint64) bool {
+	return !u.Coinbase || height >= u.Height+CoinbaseMaturity
+}
+
+func (u *UTXOs) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(u)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeUTXOs(data []byte) *UTXOs {
+	var utxos UTXOs
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&utxos)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &utxos
+}
+
+// 找到锁定脚本是lockingScripts中任意一个的所有UTXO，带上outpoint，转账时从中选币，参考SelectCoins
+//  还没有成熟的挖矿交易output不能花费，不会返回
+func (u UTXOSet) FindCoins(lockingScripts ...[]byte) []*Coin {
+	var coins []*Coin
+	// 新交易最早被打包进下一个区块
+	height := u.bc.GetBestHeight() + 1
+	scripts := make(map[string]bool)
+	for _, script := range lockingScripts {
+		scripts[string(script)] = true
+	}
+
+	u.bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		cursor := bucket.Cursor()
+
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			outs := DeserializeUTXOs(v)
+			if !outs.IsMature(height) {
+				continue
+			}
+			for i, output := range outs.Outputs {
+				if scripts[string(output.ScriptPubKey)] {
+					coins = append(coins, &Coin{
+						TxID:         append([]byte{}, k...),
+						Index:        i,
+						Amount:       output.Amount,
+						ScriptPubKey: output.ScriptPubKey,
+					})
+				}
+			}
+		}
+		return nil
+	})
+
+	return coins
+}
+
+// 找到指定锁定脚本的所有的UTXO
+func (u UTXOSet) FindUTXO(lockingScript []byte) []*TxOutput {
+	var utxos = make([]*TxOutput, 0, 4)
+
+	u.bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		cursor := bucket.Cursor()
+
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			outs := DeserializeUTXOs(v)
+			for _, output := range outs.Outputs {
+				if bytes.Equal(output.ScriptPubKey, lockingScript) {
+					utxos = append(utxos, output)
+				}
+			}
+		}
+		return nil
+	})
+
+	return utxos
+}
+
+// 查找某一个未花费的output，不存在(已经被花费或者交易不存在)时返回false
+func (u UTXOSet) FindOutput(txID []byte, index int) (*TxOutput, bool) {
+	var output *TxOutput
+
+	u.bc.db.View(func(tx *bolt.Tx) error {
+		output = getUTXO(tx.Bucket([]byte(utxoBucket)), txID, index)
+		return nil
+	})
+
+	return output, output != nil
+}
+
+// 统计指定锁定脚本的余额
+//  @return int64 已经上链的余额，包括还没有成熟的挖矿交易output
+//  @return int64 其中还没有成熟、暂时不能花费的余额
+func (u UTXOSet) FindBalance(lockingScript []byte) (int64, int64) {
+	var confirmed, immature int64
+	height := u.bc.GetBestHeight() + 1
+
+	u.bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			outs := DeserializeUTXOs(v)
+			for _, output := range outs.Outputs {
+				if !bytes.Equal(output.ScriptPubKey, lockingScript) {
+					continue
+				}
+				confirmed += output.Amount
+				if !outs.IsMature(height) {
+					immature += output.Amount
+				}
+			}
+			return nil
+		})
+	})
+
+	return confirmed, immature
+}
+
+// 统计UTXO集合中所有未花费output的总金额，也就是当前实际流通的币
+func (u UTXOSet) TotalAmount() int64 {
+	var total int64
+
+	u.bc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(utxoBucket)).ForEach(func(k, v []byte) error {
+			for _, output := range DeserializeUTXOs(v).Outputs {
+				total += output.Amount
+			}
+			return nil
+		})
+	})
+
+	return total
+}
+
+// 统计UTXO集合中还有未花费output的交易数量
+func (u UTXOSet) CountTransactions() int {
+	counter := 0
+
+	u.bc.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(utxoBucket))
+		cursor := bucket.Cursor()
+
+		for k, _ := cursor.First(); k != nil; k, _ = cursor.Next() {
+			counter++
+		}
+		return nil
+	})
+
+	return counter
+}
+
+// 重建UTXO集合：清空utxoBucket和undoBucket，再从创世块开始按高度重放整个主链
+func (u UTXOSet) Reindex() {
+	bestHeight := u.bc.GetBestHeight()
+
+	err := u.bc.db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{utxoBucket, undoBucket} {
+			err := tx.DeleteBucket([]byte(name))
+			if err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			_, err = tx.CreateBucket([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+
+		for height := uint64(0); height <= bestHeight; height++ {
+			block, err := getBlockByHeight(tx, height)
+			if err != nil {
+				return err
+			}
+			err = u.Update(tx, block)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// 区块上链时被花费的output，区块回滚时要把它们放回UTXO集合
+type SpentOutput struct {
+	TxID     []byte
+	Index    int
+	Output   *TxOutput
+	Height   uint64 // output所在区块的高度
+	Coinbase bool   // 是否是挖矿交易的output
+}
+
+// 区块的回滚数据，按花费的顺序记录区块中所有input引用的output
+type BlockUndo struct {
+	SpentOutputs []*SpentOutput
+}
+
+func (undo *BlockUndo) Serialize() []byte {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	err := encoder.Encode(undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return buffer.Bytes()
+}
+
+func DeserializeBlockUndo(data []byte) *BlockUndo {
+	var undo BlockUndo
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	err := decoder.Decode(&undo)
+	if err != nil {
+		log.Panic(err)
+	}
+	return &undo
+}
+
+// 在事务中查找某一个未花费的output
+func getUTXO(bucket *bolt.Bucket, txID []byte, index int) *TxOutput {
+	data := bucket.Get(txID)
+	if data == nil {
+		return nil
+	}
+	return DeserializeUTXOs(data).Outputs[index]
+}
+
+// 在事务中查找交易所有input引用的output，用于签名和校验
+//  @return map[string]*TxOutput 以map["TxID:index"]*TxOutput形式返回
+func prevOutputsInBucket(bucket *bolt.Bucket, t *Transaction) (map[string]*TxOutput, error) {
+	prevOutputs := make(map[string]*TxOutput)
+	for _, input := range t.TxInputs {
+		output := getUTXO(bucket, input.TxID, input.Index)
+		if output == nil {
+			return nil, fmt.Errorf("output %x:%d not found in utxo set", input.TxID, input.Index)
+		}
+		prevOutputs[outpointKey(input.TxID, input.Index)] = output
+	}
+	return prevOutputs, nil
+}
+
+// 检查交易的相对时间锁，交易要被打包进指定高度的区块
+//  input的Sequence最高位为0时，引用的output上链之后至少要经过低16位指定的区块数才能花费
+func sequenceLocksInBucket(bucket *bolt.Bucket, t *Transaction, height uint64) error {
+	for _, input := range t.TxInputs {
+		if input.Sequence&SequenceLockDisableFlag != 0 {
+			continue
+		}
+		data := bucket.Get(input.TxID)
+		if data == nil {
+			return fmt.Errorf("output %x:%d not found in utxo set", input.TxID, input.Index)
+		}
+		lockHeight := DeserializeUTXOs(data).Height + uint64(input.Sequence&SequenceLockMask)
+		if height < lockHeight {
+			return fmt.Errorf("output %x:%d is locked until height %d", input.TxID, input.Index, lockHeight)
+		}
+	}
+	return nil
+}
+
+// 检查交易引用的挖矿交易output在指定高度的区块中是否已经成熟，参考CoinbaseMaturity
+func coinbaseMaturityInBucket(bucket *bolt.Bucket, t *Transaction, height uint64) error {
+	for _, input := range t.TxInputs {
+		data := bucket.Get(input.TxID)
+		if data == nil {
+			return fmt.Errorf("output %x:%d not found in utxo set", input.TxID, input.Index)
+		}
+		outs := DeserializeUTXOs(data)
+		if !outs.IsMature(height) {
+			return fmt.Errorf("coinbase output %x:%d is immature, spendable at height %d",
+				input.TxID, input.Index, outs.Height+CoinbaseMaturity)
+		}
+	}
+	return nil
+}
+
+// 检查交易引用的挖矿交易output能否在指定高度的区块中花费，参考coinbaseMaturityInBucket
+func (u UTXOSet) CheckCoinbaseMaturity(t *Transaction, height uint64) error {
+	return u.bc.db.View(func(tx *bolt.Tx) error {
+		return coinbaseMaturityInBucket(tx.Bucket([]byte(utxoBucket)), t, height)
+	})
+}
+
+// 检查交易能否被打包进指定高度的区块，参考sequenceLocksInBucket
+func (u UTXOSet) CheckSequenceLocks(t *Transaction, height uint64) error {
+	return u.bc.db.View(func(tx *bolt.Tx) error {
+		return sequenceLocksInBucket(tx.Bucket([]byte(utxoBucket)), t, height)
+	})
+}
+
+// 查找交易所有input引用的未花费output
+func (u UTXOSet) FindPrevOutputs(t *Transaction) (map[string]*TxOutput, error) {
+	var prevOutputs map[string]*TxOutput
+
+	err := u.bc.db.View(func(tx *bolt.Tx) error {
+		var err error
+		prevOutputs, err = prevOutputsInBucket(tx.Bucket([]byte(utxoBucket)), t)
+		return err
+	})
+
+	return prevOutputs, err
+}
+
+// 把一笔交易应用到UTXO集合上
+//  1. 删掉每个input引用的output，并记录到undo中
+//  2. 把交易新产生的output加进来，OP_RETURN的output永远不能被花费，不用加
+func applyTx(bucket *bolt.Bucket, t *Transaction, height uint64, undo *BlockUndo) error {
+	if !t.IsCoinBase() {
+		for _, input := range t.TxInputs {
+			data := bucket.Get(input.TxID)
+			if data == nil {
+				return fmt.Errorf("output %x:%d not found in utxo set", input.TxID, input.Index)
+			}
+			outs := DeserializeUTXOs(data)
+			output, ok := outs.Outputs[input.Index]
+			if !ok {
+				return fmt.Errorf("output %x:%d already spent", input.TxID, input.Index)
+			}
+			delete(outs.Outputs, input.Index)
+			undo.SpentOutputs = append(undo.SpentOutputs, &SpentOutput{
+				TxID:     input.TxID,
+				Index:    input.Index,
+				Output:   output,
+				Height:   outs.Height,
+				Coinbase: outs.Coinbase,
+			})
+
+			var err error
+			if len(outs.Outputs) == 0 {
+				err = bucket.Delete(input.TxID)
+			} else {
+				err = bucket.Put(input.TxID, outs.Serialize())
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	outs := &UTXOs{Outputs: make(map[int]*TxOutput), Height: height, Coinbase: t.IsCoinBase()}
+	for i, output := range t.TxOutputs {
+		if IsUnspendable(output.ScriptPubKey) {
+			continue
+		}
+		outs.Outputs[i] = output
+	}
+	if len(outs.Outputs) == 0 {
+		return nil
+	}
+	return bucket.Put(t.TxID, outs.Serialize())
+}
+
+// 新区块上链时更新UTXO集合，必须在写入区块的同一个db.Update事务中调用，保证原子性
+//  这里不校验签名，只用于重放已经校验过的区块，新区块要通过BlockChain.ProcessBlock上链
+func (u UTXOSet) Update(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(utxoBucket))
+	undo := &BlockUndo{}
+
+	for _, t := range block.Transactions {
+		err := applyTx(bucket, t, block.Height, undo)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(undoBucket)).Put(block.Hash, undo.Serialize())
+}
+
+// 区块从主链上断开时回滚UTXO集合
+//  1. 删掉区块中所有交易产生的output
+//  2. 根据undo数据，把区块中花费的output放回去(区块内部产生又花费掉的output不用放回)
+func (u UTXOSet) Rollback(tx *bolt.Tx, block *Block) error {
+	bucket := tx.Bucket([]byte(utxoBucket))
+	data := tx.Bucket([]byte(undoBucket)).Get(block.Hash)
+	if data == nil {
+		return fmt.Errorf("undo data of block %x not found", block.Hash)
+	}
+	undo := DeserializeBlockUndo(data)
+
+	created := make(map[string]struct{})
+	for _, t := range block.Transactions {
+		created[string(t.TxID)] = struct{}{}
+		err := bucket.Delete(t.TxID)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, spent := range undo.SpentOutputs {
+		if _, ok := created[string(spent.TxID)]; ok {
+			continue
+		}
+
+		outs := &UTXOs{Outputs: make(map[int]*TxOutput), Height: spent.Height, Coinbase: spent.Coinbase}
+		if data := bucket.Get(spent.TxID); data != nil {
+			outs = DeserializeUTXOs(data)
+		}
+		outs.Outputs[spent.Index] = spent.Output
+		err := bucket.Put(spent.TxID, outs.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Bucket([]byte(undoBucket)).Delete(block.Hash)
+}
@@ -3,12 +3,29 @@ package main
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"github.com/btcsuite/btcutil/base58"
 	"golang.org/x/crypto/ripemd160"
 	"log"
+	"math/big"
+)
+
+// 地址的版本号，决定了地址对应的锁定脚本
+const (
+	// 普通地址，以1开头，锁定脚本是P2PKH
+	P2PKHVersion byte = 0x00
+	// 多重签名等脚本地址，以3开头，锁定脚本是P2SH
+	P2SHVersion byte = 0x05
+)
+
+// WIF格式私钥的版本号，和BTC主网一样，压缩公钥的私钥以K或L开头，非压缩的以5开头
+const (
+	WIFVersion        byte = 0x80
+	wifCompressedFlag byte = 0x01
 )
 
 // 这里的钱包是一结构，每一个钱包保存了公钥，私钥对
@@ -16,24 +33,123 @@ import (
 type Wallet struct {
 	Private *ecdsa.PrivateKey
 	//PubKey  *ecdsa.PublicKey
-	// 约定，这里的PubKey不存储原始的公钥，而是存储X和Y拼接的字符串，在校验端重新拆分(参考r,s传递)
+	// 约定，这里的PubKey不存储原始的公钥，而是存储SEC1压缩格式的公钥，参考PubKeyBytes
+	//  旧钱包中存储的是X和Y拼接的字符串，地址是由它生成的，所以不能改
 	PubKey []byte
+	// 私钥所在的曲线，参考CurveSecp256k1
+	Curve string
+	// HD钱包导出私钥的路径，随机生成的私钥为空
+	Path string
+	// 钱包加密之后，wallet.dat中只保存加密的私钥，钱包锁住时Private为nil
+	encryptedKey []byte
 }
 
-// 创建钱包
+// wallet.dat中保存的钱包，ecdsa.PrivateKey中的曲线是接口，gob没法直接保存，所以只保存私钥的D
+//  钱包加密之后不保存D，而是保存加密后的D，参考WalletEncryption
+type walletData struct {
+	Curve        string
+	D            []byte
+	PubKey       []byte
+	EncryptedKey []byte
+	Path         string
+}
+
+// 创建钱包，和BTC一样使用secp256k1曲线
 func NewWallet() *Wallet {
-	curve := elliptic.P256()
+	curve, _ := curveByName(CurveSecp256k1)
 	privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
 	if err != nil {
 		log.Panic(err)
 	}
-	// 生成公钥，拼接X和Y
-	pubKeyOrig := privateKey.PublicKey
-	pubKey := append(pubKeyOrig.X.Bytes(), pubKeyOrig.Y.Bytes()...)
+	// 生成公钥，压缩格式
+	return &Wallet{
+		Private: privateKey,
+		PubKey:  PubKeyBytes(&privateKey.PublicKey),
+		Curve:   CurveSecp256k1,
+	}
+}
+
+// 根据曲线和私钥的D恢复钱包，公钥由私钥算出来
+func newWalletFromKey(curveName string, d []byte) (*Wallet, error) {
+	curve, err := curveByName(curveName)
+	if err != nil {
+		return nil, err
+	}
+	k := new(big.Int).SetBytes(d)
+	if k.Sign() == 0 || k.Cmp(curve.Params().N) >= 0 {
+		return nil, errors.New("private key is out of range")
+	}
+
+	privateKey := &ecdsa.PrivateKey{D: k}
+	privateKey.Curve = curve
+	privateKey.X, privateKey.Y = curve.ScalarBaseMult(d)
 	return &Wallet{
 		Private: privateKey,
-		PubKey:  pubKey,
+		PubKey:  PubKeyBytes(&privateKey.PublicKey),
+		Curve:   curveName,
+	}, nil
+}
+
+func (w *Wallet) GobEncode() ([]byte, error) {
+	wd := walletData{
+		Curve:        w.Curve,
+		PubKey:       w.PubKey,
+		EncryptedKey: w.encryptedKey,
+		Path:         w.Path,
+	}
+	if w.encryptedKey == nil {
+		wd.D = w.Private.D.Bytes()
+	}
+
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(wd)
+	return buffer.Bytes(), err
+}
+
+func (w *Wallet) GobDecode(data []byte) error {
+	var wd walletData
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&wd)
+	if err != nil {
+		return err
+	}
+	if wd.EncryptedKey != nil {
+		// 私钥是加密的，解锁之后再恢复，参考Wallets.unlock
+		*w = Wallet{PubKey: wd.PubKey, Curve: wd.Curve, Path: wd.Path, encryptedKey: wd.EncryptedKey}
+		return nil
+	}
+	wallet, err := newWalletFromKey(wd.Curve, wd.D)
+	if err != nil {
+		return err
+	}
+	// 旧钱包的公钥不是压缩格式，地址是由保存的公钥生成的，要用保存的
+	wallet.PubKey = wd.PubKey
+	wallet.Path = wd.Path
+	*w = *wallet
+	return nil
+}
+
+// 用密钥加密私钥，公钥作为附加数据，防止加密的私钥被换到别的钱包上
+func (w *Wallet) encrypt(key []byte) error {
+	encryptedKey, err := encryptSecret(key, w.Private.D.Bytes(), w.PubKey)
+	if err != nil {
+		return err
+	}
+	w.encryptedKey = encryptedKey
+	return nil
+}
+
+// 用密钥解密私钥
+func (w *Wallet) decrypt(key []byte) error {
+	d, err := decryptSecret(key, w.encryptedKey, w.PubKey)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	wallet, err := newWalletFromKey(w.Curve, d)
+	if err != nil {
+		return err
 	}
+	w.Private = wallet.Private
+	return nil
 }
 
 // 生成地址
@@ -46,9 +162,17 @@ func (w *Wallet) NewAddress() string {
 }
 
 func PubKeyHashToAddr(pubKeyHash []byte) string {
+	return encodeAddress(P2PKHVersion, pubKeyHash)
+}
+
+// 脚本hash转成P2SH地址
+func ScriptHashToAddr(scriptHash []byte) string {
+	return encodeAddress(P2SHVersion, scriptHash)
+}
+
+func encodeAddress(version byte, hash []byte) string {
 	// 拼接version
-	version := byte(00)
-	payload := append([]byte{version}, pubKeyHash...)
+	payload := append([]byte{version}, hash...)
 
 	// checksum
 	checkCode := CheckSum(payload)
@@ -86,7 +210,10 @@ func CheckSum(data []byte) []byte {
 func IsValidAddress(addr string) bool {
 	// 1. 解码
 	addrByte := base58.Decode(addr) // 25字节
-	if len(addrByte) < 24 {
+	if len(addrByte) != 25 {
+		return false
+	}
+	if addrByte[0] != P2PKHVersion && addrByte[0] != P2SHVersion {
 		return false
 	}
 
@@ -100,3 +227,52 @@ func IsValidAddress(addr string) bool {
 	// 4. 比较
 	return bytes.Equal(checksum1, checksum2)
 }
+
+// 把私钥导出成WIF格式：base58(0x80 + 32字节私钥 + [0x01] + 4字节校验码)
+//  公钥是压缩格式时加上0x01，其他工具导入后才能得到同一个地址
+//  只有secp256k1的私钥可以导出，P-256的私钥别的工具不认识
+func (w *Wallet) ExportWIF() (string, error) {
+	if w.Curve != CurveSecp256k1 {
+		return "", fmt.Errorf("%s private key can not be exported as WIF", w.Curve)
+	}
+	if w.Private == nil {
+		return "", ErrWalletLocked
+	}
+
+	payload := append([]byte{WIFVersion}, w.Private.D.FillBytes(make([]byte, 32))...)
+	if len(w.PubKey) == 1+32 {
+		payload = append(payload, wifCompressedFlag)
+	}
+	payload = append(payload, CheckSum(payload)...)
+	return base58.Encode(payload), nil
+}
+
+// 从WIF格式的私钥创建钱包，校验版本号和校验码
+func NewWalletFromWIF(wif string) (*Wallet, error) {
+	data := base58.Decode(wif)
+	// 1字节版本号 + 32字节私钥 + [1字节压缩标志] + 4字节校验码
+	if len(data) != 1+32+4 && len(data) != 1+32+1+4 {
+		return nil, errors.New("invalid WIF length")
+	}
+	payload := data[:len(data)-4]
+	if !bytes.Equal(CheckSum(payload), data[len(data)-4:]) {
+		return nil, errors.New("invalid WIF checksum")
+	}
+	if payload[0] != WIFVersion {
+		return nil, fmt.Errorf("invalid WIF version %#x", payload[0])
+	}
+	compressed := len(payload) == 1+32+1
+	if compressed && payload[33] != wifCompressedFlag {
+		return nil, errors.New("invalid WIF compression flag")
+	}
+
+	wallet, err := newWalletFromKey(CurveSecp256k1, payload[1:33])
+	if err != nil {
+		return nil, err
+	}
+	if !compressed {
+		// 非压缩格式的公钥生成的地址不一样
+		wallet.PubKey = pubKeyEncodings(&wallet.Private.PublicKey)[1]
+	}
+	return wallet, nil
+}
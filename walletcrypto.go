@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// 钱包加密
+//  1. 用scrypt从密码和随机的salt导出32字节的密钥，用AES-GCM加密每个钱包的私钥
+//  2. 地址、公钥、赎回脚本不加密，钱包锁住的时候也能查地址、查余额、创建多重签名地址
+//  3. 签名之前要先解锁：unlockWallet生成一个随机的会话密钥打印出来，用它加密钱包的密钥保存到wallet.unlock中
+//     会话密钥不保存在磁盘上，之后的命令要通过环境变量WALLET_SESSION提供，只拿到wallet.unlock是解不开的
+//     过期或者lockWallet之后删掉wallet.unlock，钱包就锁住了
+//     也可以通过环境变量WALLET_PASSPHRASE直接提供密码，适合脚本中使用
+
+const (
+	walletUnlockFile = "wallet.unlock"
+	passphraseEnv    = "WALLET_PASSPHRASE"
+	sessionEnv       = "WALLET_SESSION"
+	// 会话密钥的长度，AES-256
+	sessionKeyLen = 32
+
+	// scrypt的参数，N越大导出密钥越慢，暴力破解也越慢
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+
+	// 加密后保存在WalletEncryption.Check中，用来判断密码是否正确
+	passphraseCheck = "wallet passphrase check"
+)
+
+var (
+	ErrWalletLocked    = errors.New("wallet is locked, run unlockWallet and set the " + sessionEnv + " it prints, or set " + passphraseEnv)
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+)
+
+// 钱包的加密参数，保存在wallet.dat中
+type WalletEncryption struct {
+	Salt    []byte
+	N, R, P int
+	Check   []byte
+}
+
+// unlockWallet保存的解锁信息，Salt必须和钱包当前的一致，修改密码之后就失效了
+//  WrappedKey是用会话密钥加密的钱包密钥，Salt和Expire作为附加数据一起校验，不能被修改
+type walletUnlock struct {
+	WrappedKey []byte
+	Salt       []byte
+	Expire     int64
+}
+
+// 加密钱包密钥时的附加数据
+func (unlock *walletUnlock) additional() []byte {
+	return append(append([]byte{}, unlock.Salt...), Uint64ToByte(uint64(unlock.Expire))...)
+}
+
+// 创建新的加密参数，返回参数和导出的密钥
+func newWalletEncryption(passphrase string) (*WalletEncryption, []byte, error) {
+	salt := make([]byte, 16)
+	_, err := io.ReadFull(rand.Reader, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := &WalletEncryption{Salt: salt, N: scryptN, R: scryptR, P: scryptP}
+	key, err := enc.deriveKey(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	enc.Check, err = encryptSecret(key, []byte(passphraseCheck), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, key, nil
+}
+
+func (enc *WalletEncryption) deriveKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), enc.Salt, enc.N, enc.R, enc.P, scryptKeyLen)
+}
+
+// 校验密钥是否正确
+func (enc *WalletEncryption) checkKey(key []byte) error {
+	check, err := decryptSecret(key, enc.Check, nil)
+	if err != nil || string(check) != passphraseCheck {
+		return ErrWrongPassphrase
+	}
+	return nil
+}
+
+// 用密码导出密钥并校验
+func (enc *WalletEncryption) Unlock(passphrase string) ([]byte, error) {
+	key, err := enc.deriveKey(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// AES-GCM加密，返回nonce+密文，additional是不加密但要校验的数据
+func encryptSecret(key, plaintext, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func decryptSecret(key, ciphertext, additional []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce := ciphertext[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 找到解锁钱包的密钥：先看环境变量中的密码，再用环境变量中的会话密钥解开unlockWallet保存的密钥
+//  wallet.unlock过期或者密码已经修改时直接删掉，不管有没有提供会话密钥
+func loadUnlockKey(enc *WalletEncryption) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(passphraseEnv); ok {
+		return enc.Unlock(passphrase)
+	}
+
+	content, err := ioutil.ReadFile(walletUnlockFile)
+	if err != nil {
+		return nil, ErrWalletLocked
+	}
+	var unlock walletUnlock
+	err = gob.NewDecoder(bytes.NewReader(content)).Decode(&unlock)
+	if err != nil || time.Now().Unix() >= unlock.Expire || !bytes.Equal(unlock.Salt, enc.Salt) {
+		os.Remove(walletUnlockFile)
+		return nil, ErrWalletLocked
+	}
+
+	session, err := hex.DecodeString(os.Getenv(sessionEnv))
+	if err != nil || len(session) != sessionKeyLen {
+		return nil, ErrWalletLocked
+	}
+	key, err := decryptSecret(session, unlock.WrappedKey, unlock.additional())
+	if err != nil {
+		return nil, fmt.Errorf("%s does not match %s", sessionEnv, walletUnlockFile)
+	}
+	err = enc.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// 用新的会话密钥加密钱包的密钥保存下来，timeout之后自动失效
+//  @return string 十六进制的会话密钥，只返回给用户，不保存
+func saveUnlockKey(enc *WalletEncryption, key []byte, timeout time.Duration) (string, error) {
+	session := make([]byte, sessionKeyLen)
+	_, err := io.ReadFull(rand.Reader, session)
+	if err != nil {
+		return "", err
+	}
+
+	unlock := walletUnlock{
+		Salt:   enc.Salt,
+		Expire: time.Now().Add(timeout).Unix(),
+	}
+	unlock.WrappedKey, err = encryptSecret(session, key, unlock.additional())
+	if err != nil {
+		return "", err
+	}
+
+	var buffer bytes.Buffer
+	err = gob.NewEncoder(&buffer).Encode(unlock)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(walletUnlockFile, buffer.Bytes(), 0600)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(session), nil
+}
+
+// 删掉解锁的密钥，文件不存在不算错误
+func removeUnlockKey() error {
+	err := os.Remove(walletUnlockFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+// 从标准输入读取一行密码，可以用管道传进来
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", fmt.Errorf("read passphrase failed: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// 读取新密码，需要输入两次
+func readNewPassphrase() (string, error) {
+	passphrase, err := readPassphrase("new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase == "" {
+		return "", errors.New("passphrase can not be empty")
+	}
+	confirm, err := readPassphrase("repeat new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if passphrase != confirm {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
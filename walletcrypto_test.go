@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// 在临时目录中创建加密参数，环境变量中不能有密码，否则不会读取wallet.unlock
+func setupUnlockTest(t *testing.T) (*WalletEncryption, []byte) {
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chdir(t.TempDir())
+	passphrase, hasPassphrase := os.LookupEnv(passphraseEnv)
+	os.Unsetenv(passphraseEnv)
+	t.Cleanup(func() {
+		os.Chdir(dir)
+		os.Unsetenv(sessionEnv)
+		if hasPassphrase {
+			os.Setenv(passphraseEnv, passphrase)
+		}
+	})
+
+	enc, key, err := newWalletEncryption("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return enc, key
+}
+
+func unlockFileExists() bool {
+	_, err := os.Stat(walletUnlockFile)
+	return err == nil
+}
+
+func TestUnlockKeyNeedsSession(t *testing.T) {
+	enc, key := setupUnlockTest(t)
+
+	session, err := saveUnlockKey(enc, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(walletUnlockFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(content, key) {
+		t.Fatal("wallet.unlock contains the raw key")
+	}
+
+	if _, err := loadUnlockKey(enc); err != ErrWalletLocked {
+		t.Fatalf("loadUnlockKey() without session: %v, want ErrWalletLocked", err)
+	}
+	os.Setenv(sessionEnv, session)
+	loaded, err := loadUnlockKey(enc)
+	if err != nil || !bytes.Equal(loaded, key) {
+		t.Fatalf("loadUnlockKey() with session: %x, %v", loaded, err)
+	}
+
+	// 另一次unlockWallet的会话密钥解不开
+	other, err := saveUnlockKey(enc, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == session {
+		t.Fatal("session key is reused")
+	}
+	if _, err := loadUnlockKey(enc); err == nil {
+		t.Fatal("loadUnlockKey() with an old session succeeded")
+	}
+}
+
+func TestUnlockKeyRemovedOnLock(t *testing.T) {
+	enc, key := setupUnlockTest(t)
+
+	session, err := saveUnlockKey(enc, key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(sessionEnv, session)
+
+	err = removeUnlockKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unlockFileExists() {
+		t.Fatal("wallet.unlock still exists after lock")
+	}
+	if _, err := loadUnlockKey(enc); err != ErrWalletLocked {
+		t.Fatalf("loadUnlockKey() after lock: %v, want ErrWalletLocked", err)
+	}
+}
+
+func TestUnlockKeyRemovedOnExpiry(t *testing.T) {
+	enc, key := setupUnlockTest(t)
+
+	// 过期之后没有会话密钥也要删掉
+	_, err := saveUnlockKey(enc, key, -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadUnlockKey(enc); err != ErrWalletLocked {
+		t.Fatalf("loadUnlockKey() after expiry: %v, want ErrWalletLocked", err)
+	}
+	if unlockFileExists() {
+		t.Fatal("wallet.unlock still exists after expiry")
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"github.com/btcsuite/btcutil/base58"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
 )
 
@@ -14,29 +17,247 @@ import (
 type Wallets struct {
 	//map[地址]钱包
 	WalletsMap map[string]*Wallet
+	// 多重签名地址，map[P2SH地址]赎回脚本
+	RedeemScripts map[string][]byte
+	// 钱包的加密参数，没有加密时为nil
+	Encryption *WalletEncryption
+	// HD钱包的种子，旧版本的钱包和没有执行过newWallet的钱包为nil
+	HD *HDWallet
+	// 只查看余额、不能花费的地址，map[地址]公钥，只知道地址时公钥为nil
+	WatchOnly map[string][]byte
+
+	// 解锁之后的密钥，不保存
+	key []byte
+	// 没能解锁的原因，需要私钥时返回给调用者
+	lockErr error
 }
 
 // 创建方法
+//  钱包加密时，如果提供了密码或者已经用unlockWallet解锁，就解密所有的私钥
 func NewWallets() *Wallets {
 	var ws Wallets
 	ws.WalletsMap = make(map[string]*Wallet)
 	ws.loadWallets()
+	// 旧版本的wallet.dat中没有多重签名地址和只查看的地址
+	if ws.RedeemScripts == nil {
+		ws.RedeemScripts = make(map[string][]byte)
+	}
+	if ws.WatchOnly == nil {
+		ws.WatchOnly = make(map[string][]byte)
+	}
+
+	if ws.Encryption != nil {
+		key, err := loadUnlockKey(ws.Encryption)
+		if err == nil {
+			err = ws.unlock(key)
+		}
+		ws.lockErr = err
+	}
 	return &ws
 }
 
-func (ws *Wallets) CreateWallet() string {
-	wallet := NewWallet()
+// 用密钥解密所有的私钥
+func (ws *Wallets) unlock(key []byte) error {
+	if ws.HD != nil && ws.HD.seed == nil {
+		err := ws.HD.decrypt(key)
+		if err != nil {
+			return fmt.Errorf("unlock HD seed failed: %v", err)
+		}
+	}
+	for address, wallet := range ws.WalletsMap {
+		if wallet.Private != nil {
+			continue
+		}
+		err := wallet.decrypt(key)
+		if err != nil {
+			return fmt.Errorf("unlock wallet %s failed: %v", address, err)
+		}
+	}
+	ws.key = key
+	return nil
+}
+
+// 钱包是否已经加密
+func (ws *Wallets) IsEncrypted() bool {
+	return ws.Encryption != nil
+}
+
+// 需要私钥之前检查钱包是否已经解锁，没有加密的钱包总是解锁的
+func (ws *Wallets) CheckUnlocked() error {
+	if ws.Encryption == nil || ws.key != nil {
+		return nil
+	}
+	if ws.lockErr != nil {
+		return ws.lockErr
+	}
+	return ErrWalletLocked
+}
+
+// 从HD钱包的种子导出下一个地址，需要先用InitHD或者Restore设置种子
+func (ws *Wallets) CreateWallet() (string, error) {
+	if ws.HD == nil {
+		return "", errors.New("wallet has no HD seed")
+	}
+	// 加密的钱包要先解锁才能用种子导出私钥，并用密钥加密新的私钥
+	err := ws.CheckUnlocked()
+	if err != nil {
+		return "", err
+	}
+	wallet, err := ws.HD.Next()
+	if err != nil {
+		return "", err
+	}
 	address := wallet.NewAddress()
 	ws.WalletsMap[address] = wallet
 
 	ws.saveWallets()
-	return address
+	return address, nil
+}
+
+// 导入其他工具导出的私钥，返回地址
+//  之前只查看的地址导入私钥之后就可以花费了
+func (ws *Wallets) ImportKey(wallet *Wallet) (string, error) {
+	address := wallet.NewAddress()
+	if ws.WalletsMap[address] != nil {
+		return "", fmt.Errorf("address %s is already in wallet", address)
+	}
+	// 加密的钱包要用密钥加密导入的私钥
+	err := ws.CheckUnlocked()
+	if err != nil {
+		return "", err
+	}
+	ws.WalletsMap[address] = wallet
+	delete(ws.WatchOnly, address)
+
+	ws.saveWallets()
+	return address, nil
+}
+
+// 添加只查看的地址，pubKey可以为nil，不需要解锁钱包
+func (ws *Wallets) AddWatchOnly(address string, pubKey []byte) error {
+	if !IsValidAddress(address) {
+		return fmt.Errorf("address %s is invalid", address)
+	}
+	if ws.WalletsMap[address] != nil || ws.RedeemScripts[address] != nil {
+		return fmt.Errorf("address %s is already in wallet", address)
+	}
+	if _, ok := ws.WatchOnly[address]; ok && pubKey == nil {
+		return fmt.Errorf("address %s is already watched", address)
+	}
+	ws.WatchOnly[address] = pubKey
+
+	ws.saveWallets()
+	return nil
+}
+
+// 地址是否是只查看的
+func (ws *Wallets) IsWatchOnly(address string) bool {
+	_, ok := ws.WatchOnly[address]
+	return ok
+}
+
+// 用密码加密钱包，已经加密的钱包要用ChangePassphrase修改密码
+func (ws *Wallets) Encrypt(passphrase string) error {
+	if ws.Encryption != nil {
+		return errors.New("wallet is already encrypted")
+	}
+	return ws.encryptWith(passphrase)
+}
+
+// 修改密码，旧密码必须正确，之前用unlockWallet保存的密钥也随之失效
+func (ws *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if ws.Encryption == nil {
+		return errors.New("wallet is not encrypted")
+	}
+	key, err := ws.Encryption.Unlock(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	err = ws.unlock(key)
+	if err != nil {
+		return err
+	}
+
+	err = ws.encryptWith(newPassphrase)
+	if err != nil {
+		return err
+	}
+	return removeUnlockKey()
+}
+
+// 生成新的salt和密钥，重新加密所有的私钥并保存
+func (ws *Wallets) encryptWith(passphrase string) error {
+	enc, key, err := newWalletEncryption(passphrase)
+	if err != nil {
+		return err
+	}
+	if ws.HD != nil {
+		err = ws.HD.encrypt(key)
+		if err != nil {
+			return err
+		}
+	}
+	for _, wallet := range ws.WalletsMap {
+		err = wallet.encrypt(key)
+		if err != nil {
+			return err
+		}
+	}
+	ws.Encryption = enc
+	ws.key = key
+	ws.lockErr = nil
+
+	ws.saveWallets()
+	return nil
+}
+
+// 添加一个m-of-n的多重签名地址，返回P2SH地址
+//  公钥的顺序会影响赎回脚本，所有人必须用相同的顺序才能得到同一个地址
+func (ws *Wallets) AddMultiSig(m int, pubKeys [][]byte) (string, error) {
+	redeemScript, err := NewMultiSigScript(m, pubKeys)
+	if err != nil {
+		return "", err
+	}
+	address := ScriptHashToAddr(HashPubKey(redeemScript))
+	ws.RedeemScripts[address] = redeemScript
+
+	ws.saveWallets()
+	return address, nil
+}
+
+// 根据公钥找到对应的钱包，不是自己的公钥时返回nil
+func (ws *Wallets) WalletByPubKey(pubKey []byte) *Wallet {
+	return ws.WalletsMap[PubKeyHashToAddr(HashPubKey(pubKey))]
 }
 
 // 保存方法，把新建的wallet添加进去
+//  钱包加密时，新建的wallet还没有加密，先加密再保存，只有解锁之后才能新建wallet
 func (ws *Wallets) saveWallets() {
+	if ws.Encryption != nil {
+		if ws.HD != nil && ws.HD.encryptedSeed == nil {
+			if ws.key == nil {
+				log.Panic(ErrWalletLocked)
+			}
+			err := ws.HD.encrypt(ws.key)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+		for _, wallet := range ws.WalletsMap {
+			if wallet.encryptedKey != nil {
+				continue
+			}
+			if ws.key == nil {
+				log.Panic(ErrWalletLocked)
+			}
+			err := wallet.encrypt(ws.key)
+			if err != nil {
+				log.Panic(err)
+			}
+		}
+	}
+
 	var buffer bytes.Buffer
-	gob.Register(elliptic.P256()) // 注册这个Curve
 	encoder := gob.NewEncoder(&buffer)
 	err := encoder.Encode(ws)
 	if err != nil {
@@ -62,14 +283,70 @@ func (ws *Wallets) loadWallets() {
 	}
 
 	// 解码
-	gob.Register(elliptic.P256()) // 注册这个Curve
 	decoder := gob.NewDecoder(bytes.NewReader(content))
 	err = decoder.Decode(ws)
+	if err != nil {
+		// 旧版本的wallet.dat直接保存了ecdsa.PrivateKey
+		err = ws.loadLegacyWallets(content)
+	}
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
+// 旧版本的wallet.dat，注册了elliptic.P256()之后直接保存ecdsa.PrivateKey
+//  曲线以"crypto/elliptic.p256Curve"的名字保存，只有CurveParams一个字段
+type legacyWallets struct {
+	WalletsMap    map[string]*legacyWallet
+	RedeemScripts map[string][]byte
+}
+
+type legacyWallet struct {
+	Private *legacyPrivateKey
+	PubKey  []byte
+}
+
+type legacyPrivateKey struct {
+	PublicKey legacyPublicKey
+	D         *big.Int
+}
+
+type legacyPublicKey struct {
+	Curve interface{}
+	X, Y  *big.Int
+}
+
+type legacyP256Curve struct {
+	CurveParams *elliptic.CurveParams
+}
+
+func init() {
+	gob.RegisterName("crypto/elliptic.p256Curve", legacyP256Curve{})
+}
+
+// 读取旧版本的wallet.dat，旧钱包都是P-256曲线的，下次保存时就变成新的格式了
+func (ws *Wallets) loadLegacyWallets(content []byte) error {
+	var legacy legacyWallets
+	err := gob.NewDecoder(bytes.NewReader(content)).Decode(&legacy)
+	if err != nil {
+		return err
+	}
+
+	for address, lw := range legacy.WalletsMap {
+		if lw.Private == nil || lw.Private.D == nil {
+			return fmt.Errorf("wallet %s has no private key", address)
+		}
+		wallet, err := newWalletFromKey(CurveP256, lw.Private.D.Bytes())
+		if err != nil {
+			return fmt.Errorf("wallet %s: %v", address, err)
+		}
+		wallet.PubKey = lw.PubKey
+		ws.WalletsMap[address] = wallet
+	}
+	ws.RedeemScripts = legacy.RedeemScripts
+	return nil
+}
+
 // 获取所有的address
 func (ws *Wallets) GetAllAddress() []string {
 	var ret []string
@@ -79,7 +356,7 @@ func (ws *Wallets) GetAllAddress() []string {
 	return ret
 }
 
-// 通过地址返回公钥的hash
+// 通过地址返回公钥的hash，P2SH地址返回的是脚本的hash
 func GetPubKeyFromAddress(addr string) []byte {
 	// 1. 解码
 	addrByte := base58.Decode(addr) // 25字节
@@ -88,3 +365,17 @@ func GetPubKeyFromAddress(addr string) []byte {
 
 	return pubKeyHash
 }
+
+// 是否是P2SH地址
+func IsScriptAddress(addr string) bool {
+	addrByte := base58.Decode(addr)
+	return len(addrByte) == 25 && addrByte[0] == P2SHVersion
+}
+
+// 通过地址生成锁定脚本，P2SH地址生成P2SH脚本，普通地址生成P2PKH脚本
+func AddressToScript(addr string) []byte {
+	if IsScriptAddress(addr) {
+		return NewP2SHScript(GetPubKeyFromAddress(addr))
+	}
+	return NewP2PKHScript(GetPubKeyFromAddress(addr))
+}